@@ -4,4 +4,4 @@ echo "Removing product and release folder. Then build sumo-logic-nozzle.zip"
 echo "*************************************************************************"
 rm sumo-logic-nozzle.zip
 rm -rf product release
-zip -r sumo-logic-nozzle.zip bitbucket-pipelines.yml vendor/ caching/ ci/ eventQueue/ eventRouting/ events/ firehoseclient/ LICENSE logging/ main.go manifest.yml event.db Procfile sumoCFFirehose/ utils/ 
+zip -r sumo-logic-nozzle.zip bitbucket-pipelines.yml vendor/ caching/ ci/ eventQueue/ eventRouting/ events/ firehoseclient/ filter/ health/ LICENSE logging/ config.go credentials.go endpoints.go main.go metrics/ spool/ manifest.yml event.db Procfile sumoCFFirehose/ utils/ 
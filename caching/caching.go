@@ -24,10 +24,11 @@ type Caching interface {
 	GetAllApp() []App
 	GetAppInfo(string) App
 	GetAppInfoCache(string) App
+	CacheStats() (uint64, uint64)
 	Close()
 }
 
 func IsNeeded(wantedEvents string) bool {
-	r := regexp.MustCompile("LogMessage|HttpStartStop|ContainerMetric")
+	r := regexp.MustCompile("LogMessage|HttpStart|HttpStop|ContainerMetric|Gauge|Timer")
 	return r.MatchString(wantedEvents)
 }
@@ -5,6 +5,7 @@ import (
 
 	"log"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -15,6 +16,8 @@ import (
 type CachingBolt struct {
 	GcfClient *cfClient.Client
 	Appdb     *bolt.DB
+	hits      uint64
+	misses    uint64
 }
 
 func NewCachingBolt(gcfClientSet *cfClient.Client, boltDatabasePath string) Caching {
@@ -166,9 +169,17 @@ func (c *CachingBolt) isOptOut(envVar map[string]interface{}) bool {
 
 func (c *CachingBolt) GetAppInfoCache(appGuid string) App {
 	if app := c.GetAppInfo(appGuid); app.Name != "" {
+		atomic.AddUint64(&c.hits, 1)
 		return app
 	} else {
+		atomic.AddUint64(&c.misses, 1)
 		c.GetAppByGuid(appGuid)
 	}
 	return c.GetAppInfo(appGuid)
 }
+
+// CacheStats returns the number of app lookups served from the cache (hits)
+// and from the Cloud Controller (misses).
+func (c *CachingBolt) CacheStats() (uint64, uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
@@ -33,3 +33,7 @@ func (c *CachingEmpty) Close() {}
 func (c *CachingEmpty) GetAppInfoCache(appGuid string) App {
 	return App{}
 }
+
+func (c *CachingEmpty) CacheStats() (uint64, uint64) {
+	return 0, 0
+}
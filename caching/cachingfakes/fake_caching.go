@@ -47,6 +47,13 @@ type FakeCaching struct {
 	getAppInfoCacheReturns struct {
 		result1 caching.App
 	}
+	CacheStatsStub        func() (uint64, uint64)
+	cacheStatsMutex       sync.RWMutex
+	cacheStatsArgsForCall []struct{}
+	cacheStatsReturns     struct {
+		result1 uint64
+		result2 uint64
+	}
 	CloseStub        func()
 	closeMutex       sync.RWMutex
 	closeArgsForCall []struct{}
@@ -218,6 +225,32 @@ func (fake *FakeCaching) GetAppInfoCacheReturns(result1 caching.App) {
 	}{result1}
 }
 
+func (fake *FakeCaching) CacheStats() (uint64, uint64) {
+	fake.cacheStatsMutex.Lock()
+	fake.cacheStatsArgsForCall = append(fake.cacheStatsArgsForCall, struct{}{})
+	fake.recordInvocation("CacheStats", []interface{}{})
+	fake.cacheStatsMutex.Unlock()
+	if fake.CacheStatsStub != nil {
+		return fake.CacheStatsStub()
+	} else {
+		return fake.cacheStatsReturns.result1, fake.cacheStatsReturns.result2
+	}
+}
+
+func (fake *FakeCaching) CacheStatsCallCount() int {
+	fake.cacheStatsMutex.RLock()
+	defer fake.cacheStatsMutex.RUnlock()
+	return len(fake.cacheStatsArgsForCall)
+}
+
+func (fake *FakeCaching) CacheStatsReturns(result1 uint64, result2 uint64) {
+	fake.CacheStatsStub = nil
+	fake.cacheStatsReturns = struct {
+		result1 uint64
+		result2 uint64
+	}{result1, result2}
+}
+
 func (fake *FakeCaching) Close() {
 	fake.closeMutex.Lock()
 	fake.closeArgsForCall = append(fake.closeArgsForCall, struct{}{})
@@ -249,6 +282,8 @@ func (fake *FakeCaching) Invocations() map[string][][]interface{} {
 	defer fake.getAppInfoMutex.RUnlock()
 	fake.getAppInfoCacheMutex.RLock()
 	defer fake.getAppInfoCacheMutex.RUnlock()
+	fake.cacheStatsMutex.RLock()
+	defer fake.cacheStatsMutex.RUnlock()
 	fake.closeMutex.RLock()
 	defer fake.closeMutex.RUnlock()
 	return fake.invocations
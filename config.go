@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventRouting"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/filter"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/sumoCFFirehose"
+	"github.com/alecthomas/kingpin/v2"
+	"gopkg.in/yaml.v3"
+)
+
+type sumoConfigStruct struct {
+	Endpoint                    string `json:"endpoint"`
+	PostMinimumDelay            string `json:"sumo_post_minimum_delay"`
+	FlushInterval               string `json:"sumo_flush_interval"`
+	MaxRetryDuration            string `json:"sumo_max_retry_duration"`
+	Category                    string `json:"sumo_category"`
+	Name                        string `json:"sumo_name"`
+	Host                        string `json:"sumo_host"`
+	Fields                      string `json:"sumo_fields"`
+	CustomMetadata              string `json:"custom_metadata"`
+	IncludeOnlyMatchingFilter   string `json:"include_only_matching_filter"`
+	ExcludeAlwaysMatchingFilter string `json:"exclude_always_matching_filter"`
+	Filter                      string `json:"filter"`
+	Events                      string `json:"events"`
+	GUID                        string `json:"guid"`
+
+	postMinimumDelay time.Duration
+	flushInterval    time.Duration
+	maxRetryDuration time.Duration
+}
+
+func (s sumoConfigStruct) String() string {
+	return fmt.Sprintf("\n"+
+		"Sumo Logic Endpoint: %v\n"+
+		"Sumo Logic HTTP Post Minimum Delay: %v\n"+
+		"Sumo Logic Flush Interval: %v\n"+
+		"Sumo Logic Max Retry Duration: %v\n"+
+		"Sumo Logic Name: %v\n"+
+		"Sumo Logic Host: %v\n"+
+		"Sumo Logic Category: %v\n"+
+		"Sumo Logic Fields: %v\n"+
+		"Custom Metadata: %v\n"+
+		"Include Only Matching Filter: %v\n"+
+		"Exclude Always Matching Filter: %v\n"+
+		"Filter: %v\n"+
+		"Events: %v\n",
+		s.Endpoint,
+		s.PostMinimumDelay,
+		s.FlushInterval,
+		s.MaxRetryDuration,
+		s.Name,
+		s.Host,
+		s.Category,
+		s.Fields,
+		s.CustomMetadata,
+		s.IncludeOnlyMatchingFilter,
+		s.ExcludeAlwaysMatchingFilter,
+		s.Filter,
+		s.Events)
+}
+
+// secrets returns the endpoint URL, which holds the collector token, and the
+// parts of it that may be logged on their own: its query and its password.
+func (s sumoConfigStruct) secrets() []string {
+	secrets := []string{s.Endpoint}
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return secrets
+	}
+	if endpoint.RawQuery != "" {
+		secrets = append(secrets, endpoint.RawQuery)
+	}
+	if endpoint.User != nil {
+		if password, set := endpoint.User.Password(); set {
+			secrets = append(secrets, password)
+		}
+	}
+	return secrets
+}
+
+// maskSecrets masks the Cloud Foundry credentials and the endpoint tokens in
+// the log output.
+func maskSecrets(configs []sumoConfigStruct) {
+	logging.AddSecret(*password)
+	logging.AddSecret(*clientSecret)
+	for _, config := range configs {
+		for _, secret := range config.secrets() {
+			logging.AddSecret(secret)
+		}
+	}
+}
+
+// applyDefaults fills the settings left empty with their default value.
+func (s *sumoConfigStruct) applyDefaults() {
+	if s.PostMinimumDelay == "" {
+		s.PostMinimumDelay = defaultPostMinimumDelay.String()
+	}
+	if s.FlushInterval == "" {
+		s.FlushInterval = defaultFlushInterval.String()
+	}
+	if s.MaxRetryDuration == "" {
+		s.MaxRetryDuration = defaultMaxRetryDuration.String()
+	}
+}
+
+// keyError is an invalid setting, named after its key so that the
+// configuration file can report its line.
+type keyError struct {
+	key string
+	err error
+}
+
+func (e *keyError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.key, e.err)
+}
+
+// validate checks the settings of an endpoint, once the defaults are applied,
+// and parses its durations.
+func (s *sumoConfigStruct) validate() error {
+	endpoint, err := url.Parse(s.Endpoint)
+	if s.Endpoint == "" {
+		return &keyError{"endpoint", errors.New("the endpoint URL is required")}
+	}
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return &keyError{"endpoint", errors.New("expected an http or https URL")}
+	}
+	if s.postMinimumDelay, err = parseDuration(s.PostMinimumDelay, 0); err != nil {
+		return &keyError{"sumo_post_minimum_delay", err}
+	}
+	if s.flushInterval, err = parseDuration(s.FlushInterval, time.Nanosecond); err != nil {
+		return &keyError{"sumo_flush_interval", err}
+	}
+	if s.maxRetryDuration, err = parseDuration(s.MaxRetryDuration, 0); err != nil {
+		return &keyError{"sumo_max_retry_duration", err}
+	}
+	if err := sumoCFFirehose.ValidateFields(s.Fields); err != nil {
+		return &keyError{"sumo_fields", err}
+	}
+	if err := validateKeyValues(s.CustomMetadata); err != nil {
+		return &keyError{"custom_metadata", err}
+	}
+	if err := validateKeyValues(s.IncludeOnlyMatchingFilter); err != nil {
+		return &keyError{"include_only_matching_filter", err}
+	}
+	if err := validateKeyValues(s.ExcludeAlwaysMatchingFilter); err != nil {
+		return &keyError{"exclude_always_matching_filter", err}
+	}
+	if _, err := filter.Parse(s.Filter); err != nil {
+		return &keyError{"filter", err}
+	}
+	if strings.TrimSpace(s.Events) != "" {
+		if _, err := eventRouting.ParseEvents(s.Events); err != nil {
+			return &keyError{"events", err}
+		}
+	}
+	return nil
+}
+
+func parseDuration(value string, minimum time.Duration) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration < minimum {
+		return 0, fmt.Errorf("%v is below the minimum of %v", duration, minimum)
+	}
+	return duration, nil
+}
+
+// validateKeyValues checks a key1:value1,key2:value2 list.
+func validateKeyValues(value string) error {
+	if value == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		if !strings.Contains(entry, ":") {
+			return fmt.Errorf("expected key:value, got %q", entry)
+		}
+	}
+	return nil
+}
+
+func parseSumoConfigs(jsonString string) ([]sumoConfigStruct, error) {
+	res := []sumoConfigStruct{}
+	decoder := json.NewDecoder(strings.NewReader(jsonString))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&res); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, errors.New("at least one endpoint is required")
+	}
+	for i := range res {
+		res[i].applyDefaults()
+		if err := res[i].validate(); err != nil {
+			return nil, fmt.Errorf("endpoint %d: %v", i+1, err)
+		}
+	}
+	return res, nil
+}
+
+// loadConfigFile applies the settings of the --config file as the defaults of
+// the flags, so that the flags and their environment variables still override
+// them. It must be called before the flags are parsed.
+func loadConfigFile(app *kingpin.Application, args []string) error {
+	path := os.Getenv("CONFIG_FILE")
+	if value, found := flagArgument(app, args, "config"); found {
+		path = value
+	}
+	if path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return applyConfig(app, path, content)
+}
+
+// endpointsOverridden tells whether the endpoints are set by the
+// --sumo_endpoints flag or the SUMO_ENDPOINTS or SUMO_ENDPOINTS_FILE
+// environment variables, rather than by the configuration file.
+func endpointsOverridden(app *kingpin.Application, args []string) bool {
+	_, found := flagArgument(app, args, "sumo_endpoints")
+	return found || os.Getenv("SUMO_ENDPOINTS") != "" || os.Getenv("SUMO_ENDPOINTS_FILE") != ""
+}
+
+// flagArgument returns the value of a flag on the command line.
+func flagArgument(app *kingpin.Application, args []string, name string) (string, bool) {
+	value, found := "", false
+	if context, err := app.ParseContext(args); err == nil {
+		for _, element := range context.Elements {
+			if flag, ok := element.Clause.(*kingpin.FlagClause); ok && flag.Model().Name == name && element.Value != nil {
+				value, found = *element.Value, true
+			}
+		}
+	}
+	return value, found
+}
+
+// applyConfig validates a configuration file, a YAML or JSON mapping of flag
+// names, and sets its values as the defaults of the flags.
+func applyConfig(app *kingpin.Application, name string, content []byte) error {
+	root, err := configRoot(name, content)
+	if root == nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if seen[key.Value] {
+			return configError(name, key, "duplicate setting %q", key.Value)
+		}
+		seen[key.Value] = true
+
+		flag := app.GetFlag(key.Value)
+		if flag == nil || flag.Model().Envar == "" || key.Value == "config" {
+			return configError(name, key, "unknown setting %q", key.Value)
+		}
+		if key.Value == "sumo_endpoints" && value.Kind == yaml.SequenceNode {
+			endpoints, err := parseSumoConfigNodes(name, value)
+			if err != nil {
+				return err
+			}
+			encoded, err := json.Marshal(endpoints)
+			if err != nil {
+				return err
+			}
+			flag.Default(string(encoded))
+			continue
+		}
+		setting, err := scalarValue(value)
+		if err != nil {
+			return configError(name, value, "%s: %v", key.Value, err)
+		}
+		if err := setFlagDefault(flag, setting); err != nil {
+			return configError(name, value, "%v", err)
+		}
+	}
+	return nil
+}
+
+// setFlagDefault validates a value and sets it as the default of a flag.
+func setFlagDefault(flag *kingpin.FlagClause, value string) error {
+	if err := flag.Model().Value.Set(value); err != nil {
+		return fmt.Errorf("invalid %s: %v", flag.Model().Name, err)
+	}
+	flag.Default(value)
+	return nil
+}
+
+// readSumoConfigs parses and validates the sumo_endpoints of a configuration
+// file, to reload them.
+func readSumoConfigs(name string, content []byte) ([]sumoConfigStruct, error) {
+	root, err := configRoot(name, content)
+	if root == nil {
+		if err == nil {
+			err = fmt.Errorf("%s: no sumo_endpoints", name)
+		}
+		return nil, err
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if key.Value != "sumo_endpoints" {
+			continue
+		}
+		if value.Kind == yaml.SequenceNode {
+			return parseSumoConfigNodes(name, value)
+		}
+		setting, err := scalarValue(value)
+		if err != nil {
+			return nil, configError(name, value, "%s: %v", key.Value, err)
+		}
+		configs, err := parseSumoConfigs(setting)
+		if err != nil {
+			return nil, configError(name, value, "invalid %s: %v", key.Value, err)
+		}
+		return configs, nil
+	}
+	return nil, configError(name, root, "no sumo_endpoints")
+}
+
+// configRoot returns the mapping of settings of a configuration file, or nil
+// when it is empty.
+func configRoot(name string, content []byte) (*yaml.Node, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, configError(name, root, "expected a mapping of settings")
+	}
+	return root, nil
+}
+
+// parseSumoConfigNodes validates the list of sumo_endpoints of a
+// configuration file, reporting the line of the invalid settings.
+func parseSumoConfigNodes(name string, node *yaml.Node) ([]sumoConfigStruct, error) {
+	fields := make(map[string]int)
+	configType := reflect.TypeOf(sumoConfigStruct{})
+	for i := 0; i < configType.NumField(); i++ {
+		if tag := configType.Field(i).Tag.Get("json"); tag != "" {
+			fields[tag] = i
+		}
+	}
+
+	configs := []sumoConfigStruct{}
+	for _, item := range node.Content {
+		if item.Kind != yaml.MappingNode {
+			return nil, configError(name, item, "expected an endpoint mapping")
+		}
+		config := sumoConfigStruct{}
+		values := make(map[string]*yaml.Node)
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			key, value := item.Content[i], item.Content[i+1]
+			field, known := fields[key.Value]
+			if !known {
+				return nil, configError(name, key, "unknown endpoint setting %q", key.Value)
+			}
+			if values[key.Value] != nil {
+				return nil, configError(name, key, "duplicate endpoint setting %q", key.Value)
+			}
+			setting, err := scalarValue(value)
+			if err != nil {
+				return nil, configError(name, value, "%s: %v", key.Value, err)
+			}
+			reflect.ValueOf(&config).Elem().Field(field).SetString(setting)
+			values[key.Value] = value
+		}
+		config.applyDefaults()
+		if err := config.validate(); err != nil {
+			at := item
+			var invalid *keyError
+			if errors.As(err, &invalid) && values[invalid.key] != nil {
+				at = values[invalid.key]
+			}
+			return nil, configError(name, at, "%v", err)
+		}
+		configs = append(configs, config)
+	}
+	if len(configs) == 0 {
+		return nil, configError(name, node, "at least one endpoint is required")
+	}
+	return configs, nil
+}
+
+// printConfig writes the effective settings in the format of the configuration
+// file, with the secrets masked.
+func printConfig(w io.Writer, app *kingpin.Application, configs []sumoConfigStruct) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, flag := range app.Model().Flags {
+		if flag.Envar == "" || flag.Name == "config" || flag.Name == "sumo_endpoints" {
+			continue
+		}
+		root.Content = append(root.Content, stringNode(flag.Name), stringNode(flag.Value.String()))
+	}
+	endpoints := &yaml.Node{Kind: yaml.SequenceNode}
+	for _, config := range configs {
+		item := &yaml.Node{Kind: yaml.MappingNode}
+		value := reflect.ValueOf(config)
+		for i := 0; i < value.NumField(); i++ {
+			tag := value.Type().Field(i).Tag.Get("json")
+			if tag == "" || value.Field(i).String() == "" {
+				continue
+			}
+			field := value.Field(i).String()
+			if tag == "endpoint" {
+				field = maskedEndpoint(field)
+			}
+			item.Content = append(item.Content, stringNode(tag), stringNode(field))
+		}
+		endpoints.Content = append(endpoints.Content, item)
+	}
+	root.Content = append(root.Content, stringNode("sumo_endpoints"), endpoints)
+
+	var content strings.Builder
+	encoder := yaml.NewEncoder(&content)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, content.String())
+	return err
+}
+
+// maskedEndpoint keeps the scheme and the host of an endpoint URL, so that the
+// printed configuration stays valid, and masks the rest.
+func maskedEndpoint(endpoint string) string {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Host == "" {
+		return logging.Mask
+	}
+	return parsed.Scheme + "://" + parsed.Host + "/" + logging.Mask
+}
+
+// stringNode is a scalar with the secrets masked, quoted when empty. The
+// settings of the configuration file are read as strings whatever their YAML
+// type.
+func stringNode(value string) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.ScalarNode, Value: logging.Redact(value)}
+	if value == "" {
+		node.Style = yaml.DoubleQuotedStyle
+	}
+	return node
+}
+
+// scalarValue returns the value of a setting, a list being joined with commas.
+func scalarValue(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("expected a list of values")
+			}
+			values = append(values, item.Value)
+		}
+		return strings.Join(values, ","), nil
+	case yaml.AliasNode:
+		return scalarValue(node.Alias)
+	}
+	return "", errors.New("expected a value or a list of values")
+}
+
+func configError(name string, node *yaml.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", name, node.Line, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+// vcapServiceLabels are the service bindings read from VCAP_SERVICES: the
+// user-provided services and the CredHub service broker instances.
+var vcapServiceLabels = []string{"user-provided", "credhub"}
+
+type vcapService struct {
+	Name        string                 `json:"name"`
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+// loadVcapServices sets the flags named after the credentials of the service
+// bindings of the app as their defaults, like the configuration file, e.g. for
+// a service created with
+//
+//	cf create-user-provided-service sumo-nozzle -p '{"sumo_endpoints": [{"endpoint": "..."}]}'
+//
+// The other credentials are ignored. It returns the name of the service
+// setting each flag, and must be called before the flags are parsed.
+func loadVcapServices(app *kingpin.Application, jsonString string) (map[string]string, error) {
+	setBy := make(map[string]string)
+	if jsonString == "" {
+		return setBy, nil
+	}
+	services := make(map[string][]vcapService)
+	decoder := json.NewDecoder(strings.NewReader(jsonString))
+	decoder.UseNumber()
+	if err := decoder.Decode(&services); err != nil {
+		return nil, fmt.Errorf("VCAP_SERVICES: %v", err)
+	}
+	for _, label := range vcapServiceLabels {
+		for _, service := range services[label] {
+			keys := make([]string, 0, len(service.Credentials))
+			for key := range service.Credentials {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				flag := app.GetFlag(key)
+				if flag == nil || flag.Model().Envar == "" || key == "config" {
+					continue
+				}
+				if other, set := setBy[key]; set {
+					return nil, fmt.Errorf("VCAP_SERVICES: %s is set by both the %s and %s services", key, other, service.Name)
+				}
+				setBy[key] = service.Name
+				value, err := credentialValue(key, service.Credentials[key])
+				if err == nil {
+					err = setFlagDefault(flag, value)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("VCAP_SERVICES service %s: %s: %v", service.Name, key, err)
+				}
+			}
+		}
+	}
+	return setBy, nil
+}
+
+// credentialValue returns a credential as a flag value. Lists are joined with
+// commas, except the list of sumo_endpoints which is encoded as JSON.
+func credentialValue(key string, credential interface{}) (string, error) {
+	switch value := credential.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool:
+		return fmt.Sprint(value), nil
+	}
+	if key == "sumo_endpoints" {
+		encoded, err := json.Marshal(credential)
+		return string(encoded), err
+	}
+	list, ok := credential.([]interface{})
+	if !ok {
+		return "", errors.New("expected a value or a list of values")
+	}
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		switch item.(type) {
+		case string, json.Number, bool:
+			values = append(values, fmt.Sprint(item))
+		default:
+			return "", errors.New("expected a list of values")
+		}
+	}
+	return strings.Join(values, ","), nil
+}
+
+// loadSecretFiles sets the flags whose environment variable, suffixed with
+// _FILE, names a file, like a mounted secret, to the content of the file
+// without its trailing newline. It must be called before the flags are parsed,
+// after the configuration file and the service bindings which it overrides.
+func loadSecretFiles(app *kingpin.Application) error {
+	for _, flag := range app.Model().Flags {
+		if flag.Envar == "" || flag.Name == "config" {
+			continue
+		}
+		name := flag.Envar + "_FILE"
+		path := os.Getenv(name)
+		if path == "" {
+			continue
+		}
+		if os.Getenv(flag.Envar) != "" {
+			return fmt.Errorf("both %s and %s are set", flag.Envar, name)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := setFlagDefault(app.GetFlag(flag.Name), strings.TrimRight(string(content), "\r\n")); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testVcapServices = `{
+  "p-mysql": [{"name": "db", "credentials": {"events": "Error", "password": "other"}}],
+  "user-provided": [{
+    "name": "sumo-nozzle",
+    "credentials": {
+      "sumo_endpoints": [{"endpoint": "https://collectors.sumologic.com/receiver/v1/http/token", "sumo_category": "logs"}],
+      "events": ["LogMessage", "Error"],
+      "log_events_batch_size": 100,
+      "skip_ssl_validation": true,
+      "uri": "ignored"
+    }
+  }]
+}`
+
+func TestLoadVcapServices(t *testing.T) {
+	flags := newTestFlags()
+	setBy, err := loadVcapServices(flags.app, testVcapServices)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"sumo_endpoints": "sumo-nozzle", "events": "sumo-nozzle", "log_events_batch_size": "sumo-nozzle", "skip_ssl_validation": "sumo-nozzle"}, setBy)
+	_, err = flags.app.Parse([]string{"--log_events_batch_size=50"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "LogMessage,Error", *flags.events)
+	assert.Equal(t, 50, *flags.batchSize, "flags override the service bindings")
+	assert.True(t, *flags.skipSSL)
+	endpoints, err := parseSumoConfigs(*flags.sumoEndpoints)
+	assert.NoError(t, err)
+	assert.Equal(t, "logs", endpoints[0].Category)
+}
+
+func TestLoadVcapServicesErrors(t *testing.T) {
+	cases := []struct {
+		services string
+		err      string
+	}{
+		{`{"user-provided": [{"name": "a", "credentials": {"events": "Error"}}], "credhub": [{"name": "b", "credentials": {"events": "LogMessage"}}]}`, "VCAP_SERVICES: events is set by both the a and b services"},
+		{`{"user-provided": [{"name": "a", "credentials": {"log_events_batch_size": "many"}}]}`, "VCAP_SERVICES service a: log_events_batch_size: invalid log_events_batch_size:"},
+		{`{"user-provided": [{"name": "a", "credentials": {"events": {"LogMessage": true}}}]}`, "VCAP_SERVICES service a: events: expected a value or a list of values"},
+		{`[]`, "VCAP_SERVICES:"},
+	}
+	for _, c := range cases {
+		_, err := loadVcapServices(newTestFlags().app, c.services)
+		if assert.Error(t, err, c.services) {
+			assert.Contains(t, err.Error(), c.err)
+		}
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sumo_endpoints")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"endpoint": "https://collectors.sumologic.com/receiver/v1/http/token"}]`+"\n"), 0600))
+	t.Setenv("TEST_SUMO_ENDPOINTS_FILE", path)
+	flags := newTestFlags()
+	assert.NoError(t, applyConfig(flags.app, "nozzle.yml", []byte(testConfig)))
+
+	assert.NoError(t, loadSecretFiles(flags.app))
+	_, err := flags.app.Parse([]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"endpoint": "https://collectors.sumologic.com/receiver/v1/http/token"}]`, *flags.sumoEndpoints, "the file overrides the configuration file")
+
+	t.Setenv("TEST_SUMO_ENDPOINTS", "[]")
+	assert.EqualError(t, loadSecretFiles(newTestFlags().app), "both TEST_SUMO_ENDPOINTS and TEST_SUMO_ENDPOINTS_FILE are set")
+	t.Setenv("TEST_SUMO_ENDPOINTS", "")
+	t.Setenv("TEST_SUMO_ENDPOINTS_FILE", filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, loadSecretFiles(newTestFlags().app))
+}
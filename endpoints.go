@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventQueue"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventRouting"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/spool"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/sumoCFFirehose"
+)
+
+// endpoint is a configured Sumo Logic endpoint, with the queue its events are
+// routed to and the appender posting them.
+type endpoint struct {
+	config    sumoConfigStruct
+	queue     *eventQueue.Queue
+	appender  *sumoCFFirehose.SumoLogicAppender
+	spoolPath string
+}
+
+// endpointSet runs the appenders of the configured endpoints, and replaces
+// them when the configuration is reloaded, without reconnecting to the
+// firehose. The spools are shared by path, so that the appender replacing an
+// endpoint keeps its spool.
+type endpointSet struct {
+	mutex     *sync.Mutex
+	endpoints []*endpoint
+	spools    map[string]*spool.Spool
+	overflow  eventQueue.OverflowPolicy
+	routing   *eventRouting.EventRouting
+	stopping  bool
+}
+
+func newEndpointSet(overflow eventQueue.OverflowPolicy) *endpointSet {
+	return &endpointSet{
+		mutex:    &sync.Mutex{},
+		spools:   make(map[string]*spool.Spool),
+		overflow: overflow,
+	}
+}
+
+// start creates and starts the endpoints of the initial configuration. The
+// routing must be set before the configuration is reloaded.
+func (s *endpointSet) start(configs []sumoConfigStruct) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, config := range configs {
+		e, err := s.newEndpoint(i, config)
+		if err != nil {
+			return err
+		}
+		s.endpoints = append(s.endpoints, e)
+	}
+	return nil
+}
+
+// queues returns the queues of the endpoints, in the order of the configuration.
+func (s *endpointSet) queues() []*eventQueue.Queue {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	queues := make([]*eventQueue.Queue, len(s.endpoints))
+	for i, e := range s.endpoints {
+		queues[i] = e.queue
+	}
+	return queues
+}
+
+// appenders returns the appenders of the endpoints, in the order of the
+// configuration.
+func (s *endpointSet) appenders() []*sumoCFFirehose.SumoLogicAppender {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	appenders := make([]*sumoCFFirehose.SumoLogicAppender, len(s.endpoints))
+	for i, e := range s.endpoints {
+		appenders[i] = e.appender
+	}
+	return appenders
+}
+
+// newEndpoint creates the queue and the appender of an endpoint and starts it.
+// Nothing is left running when it fails.
+func (s *endpointSet) newEndpoint(index int, config sumoConfigStruct) (*endpoint, error) {
+	logging.Info.Printf("Creating queue for endpoint %d", index)
+	queue := eventQueue.NewBoundedQueue(make([]*events.Event, 100), *queueMaxEvents, *queueMaxBytes, s.overflow)
+
+	logging.Info.Printf("Using post minimum delay: %v\n", config.postMinimumDelay)
+	logging.Info.Printf("Using flush interval: %v\n", config.flushInterval)
+	logging.Info.Printf("Using max retry duration: %v\n", config.maxRetryDuration)
+	appender := sumoCFFirehose.NewSumoLogicAppender(config.Endpoint, 5000, queue, *eventsBatchSize, config.postMinimumDelay, config.flushInterval, config.maxRetryDuration, config.Category, config.Name, config.Host, *verboseLogMessages, config.CustomMetadata, config.IncludeOnlyMatchingFilter, config.ExcludeAlwaysMatchingFilter, version)
+	appender.SetupMaxBatchBytes(*maxBatchBytes)
+	if err := appender.SetupFields(config.Fields); err != nil {
+		return nil, fmt.Errorf("error parsing the Sumo Logic fields: %v", err)
+	}
+	if err := appender.SetupFilter(config.Filter); err != nil {
+		return nil, fmt.Errorf("error parsing the filter: %v", err)
+	}
+	appender.SetupSenders(fmt.Sprintf("endpoint %d", index), *maxConcurrentPosts, *circuitBreakerFailures, *circuitBreakerOpenPeriod)
+
+	e := &endpoint{config: config, queue: queue, appender: appender}
+	if *spoolDirectory != "" {
+		e.spoolPath = spool.Path(*spoolDirectory, config.Endpoint)
+		endpointSpool := s.spools[e.spoolPath]
+		if endpointSpool == nil {
+			var err error
+			endpointSpool, err = spool.Open(e.spoolPath, *spoolMaxBytes, *spoolMaxAge)
+			if err != nil {
+				return nil, fmt.Errorf("error opening spool %s: %v", e.spoolPath, err)
+			}
+			s.spools[e.spoolPath] = endpointSpool
+		}
+		logging.Info.Printf("Spooling batches to: %s", e.spoolPath)
+		appender.SetupSpool(endpointSpool, spoolRetryPeriod)
+	}
+	go appender.Start() //multi
+	return e, nil
+}
+
+// reload replaces the endpoints with the ones of configs. The endpoints whose
+// settings did not change keep running, the new ones are started before the
+// events are routed to them, and the removed ones are drained in the
+// background. The current endpoints are kept when the reload fails.
+func (s *endpointSet) reload(configs []sumoConfigStruct) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopping {
+		return errors.New("the nozzle is shutting down")
+	}
+	kept := make(map[*endpoint]bool)
+	var added []*endpoint
+	next := make([]*endpoint, len(configs))
+	for i, config := range configs {
+		for _, current := range s.endpoints {
+			if !kept[current] && current.config == config {
+				next[i] = current
+				kept[current] = true
+				break
+			}
+		}
+		if next[i] != nil {
+			continue
+		}
+		e, err := s.newEndpoint(i, config)
+		if err != nil {
+			go s.retire(added)
+			return fmt.Errorf("endpoint %d: %v", i+1, err)
+		}
+		next[i] = e
+		added = append(added, e)
+	}
+
+	queues := make([]*eventQueue.Queue, len(next))
+	queueEvents := make([]string, len(next))
+	for i, e := range next {
+		queues[i] = e.queue
+		queueEvents[i] = e.config.Events
+	}
+	if err := s.routing.ReplaceQueues(queues, queueEvents); err != nil {
+		go s.retire(added)
+		return err
+	}
+
+	var removed []*endpoint
+	for _, current := range s.endpoints {
+		if !kept[current] {
+			removed = append(removed, current)
+		}
+	}
+	s.endpoints = next
+	logging.Info.Printf("Reloaded the endpoints: %d kept, %d added, %d removed", len(kept), len(added), len(removed))
+	go s.retire(removed)
+	return nil
+}
+
+// retire drains endpoints no longer receiving events, and closes their
+// spools unless a current endpoint uses them.
+func (s *endpointSet) retire(endpoints []*endpoint) {
+	for _, e := range endpoints {
+		e.appender.Drain()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, e := range endpoints {
+		if e.spoolPath == "" || s.spools[e.spoolPath] == nil || s.usesSpool(e.spoolPath) {
+			continue
+		}
+		if err := s.spools[e.spoolPath].Close(); err != nil {
+			logging.Error.Printf("Error closing spool %s: %v", e.spoolPath, err)
+		}
+		delete(s.spools, e.spoolPath)
+	}
+}
+
+func (s *endpointSet) usesSpool(path string) bool {
+	for _, e := range s.endpoints {
+		if e.spoolPath == path {
+			return true
+		}
+	}
+	return false
+}
+
+// shutdown drains the endpoints, once the routing is stopped, and closes their
+// spools. It gives up after timeout, leaving the spools open for the batches
+// being posted, and logs what was and was not delivered.
+func (s *endpointSet) shutdown(timeout time.Duration) bool {
+	s.mutex.Lock()
+	s.stopping = true
+	current := s.endpoints
+	s.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, e := range current {
+			wg.Add(1)
+			go func(e *endpoint) {
+				defer wg.Done()
+				e.appender.Drain()
+			}(e)
+		}
+		wg.Wait()
+		close(drained)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	complete := true
+	select {
+	case <-drained:
+		logging.Info.Println("Drained the endpoints")
+	case <-timer.C:
+		complete = false
+		logging.Warning.Printf("Shutdown timeout of %v reached before the endpoints were drained", timeout)
+	}
+
+	for i, e := range current {
+		stats := e.appender.Stats()
+		spooled, _, _ := e.appender.SpoolStats()
+		logging.Info.Printf("Endpoint %d: %d posts sent, %d posts failed, %d events left in the queue, %d posts in flight, %d batches spooled", i, stats.PostsSent, stats.PostsFailed, e.appender.QueueSize(), e.appender.InFlightPosts(), spooled)
+		if spooled > 0 {
+			logging.Warning.Printf("Endpoint %d: %d undelivered batches are kept in the spool until the next start", i, spooled)
+		}
+	}
+	if complete {
+		s.closeSpools()
+	}
+	return complete
+}
+
+// closeSpools closes the spools of the endpoints.
+func (s *endpointSet) closeSpools() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for path, endpointSpool := range s.spools {
+		endpointSpool.Close()
+		delete(s.spools, path)
+	}
+}
+
+// watchConfigFile reloads the sumo_endpoints of the configuration file at path
+// on SIGHUP, and when its content changes if period is greater than 0. An
+// empty path means the endpoints are not read from a configuration file, and
+// SIGHUP is ignored.
+func (s *endpointSet) watchConfigFile(path string, period time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	var changes <-chan time.Time
+	if path != "" && period > 0 {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		changes = ticker.C
+	}
+	last, _ := os.ReadFile(path)
+	for {
+		select {
+		case <-hangup:
+			if path == "" {
+				logging.Warning.Println("Received SIGHUP, but the endpoints are not read from a configuration file")
+				continue
+			}
+			logging.Info.Println("Received SIGHUP, reloading the endpoints from " + path)
+		case <-changes:
+			content, err := os.ReadFile(path)
+			if err != nil || bytes.Equal(content, last) {
+				continue
+			}
+			logging.Info.Println("Configuration file changed, reloading the endpoints from " + path)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			logging.Error.Printf("Error reading the configuration file: %v", err)
+			continue
+		}
+		last = content
+		configs, err := readSumoConfigs(path, content)
+		if err == nil {
+			maskSecrets(configs)
+			err = s.reload(configs)
+		}
+		if err != nil {
+			logging.Error.Printf("Error reloading the endpoints, keeping the current ones: %v", err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/caching"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventQueue"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventRouting"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+	sonde "github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logging.Init(io.Discard, io.Discard, io.Discard, io.Discard)
+	os.Exit(m.Run())
+}
+
+func testEndpoints(t *testing.T, server *httptest.Server, settings ...string) []sumoConfigStruct {
+	configs := make([]sumoConfigStruct, len(settings))
+	for i, category := range settings {
+		configs[i] = sumoConfigStruct{Endpoint: server.URL, Category: category, PostMinimumDelay: "0s"}
+		configs[i].applyDefaults()
+		assert.NoError(t, configs[i].validate())
+	}
+	return configs
+}
+
+func TestReloadEndpoints(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	endpoints := newEndpointSet(eventQueue.DropNewest)
+	assert.NoError(t, endpoints.start(testEndpoints(t, server, "kept", "removed")))
+	endpoints.routing = eventRouting.NewEventRouting(caching.NewCachingEmpty(), endpoints.queues())
+	assert.NoError(t, endpoints.routing.SetupEventRouting("LogMessage"))
+	assert.NoError(t, endpoints.routing.SetupQueueEvents([]string{"", ""}))
+	before := endpoints.appenders()
+
+	assert.NoError(t, endpoints.reload(testEndpoints(t, server, "added", "kept")))
+	after := endpoints.appenders()
+	assert.Len(t, after, 2)
+	assert.True(t, after[0] != before[0] && after[0] != before[1], "new endpoints get a new appender")
+	assert.True(t, before[0] == after[1], "unchanged endpoints keep their appender")
+	assert.Eventually(t, func() bool { return !before[1].Running() }, time.Second, 10*time.Millisecond, "removed endpoints are drained")
+
+	withEvents := testEndpoints(t, server, "kept")
+	withEvents[0].Events = "ValueMetric"
+	assert.Error(t, endpoints.reload(withEvents), "the events read from the firehose do not change")
+	assert.True(t, after[0] == endpoints.appenders()[0] && after[1] == endpoints.appenders()[1], "the current endpoints are kept")
+	assert.Len(t, endpoints.appenders(), 2)
+}
+
+func TestReloadWhileRoutingLosesNoEvent(t *testing.T) {
+	var lines int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := gzip.NewReader(r.Body)
+		if err == nil {
+			content, _ := io.ReadAll(body)
+			atomic.AddInt64(&lines, int64(strings.Count(string(content), "hello")))
+		}
+	}))
+	defer server.Close()
+	defer func(batchSize int) { *eventsBatchSize = batchSize }(*eventsBatchSize)
+	*eventsBatchSize = 100
+	endpoints := newEndpointSet(eventQueue.DropNewest)
+	assert.NoError(t, endpoints.start(testEndpoints(t, server, "logs")))
+	endpoints.routing = eventRouting.NewEventRouting(caching.NewCachingEmpty(), endpoints.queues())
+	assert.NoError(t, endpoints.routing.SetupEventRouting("LogMessage"))
+	assert.NoError(t, endpoints.routing.SetupQueueEvents([]string{""}))
+	before := endpoints.appenders()[0]
+
+	const routed = 5000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < routed; i++ {
+			endpoints.routing.RouteEvent(&sonde.Envelope{
+				Origin:    proto.String("rep"),
+				EventType: sonde.Envelope_LogMessage.Enum(),
+				LogMessage: &sonde.LogMessage{
+					Message:     []byte("hello"),
+					MessageType: sonde.LogMessage_OUT.Enum(),
+					Timestamp:   proto.Int64(1483629662001580713),
+				},
+			})
+		}
+	}()
+	time.Sleep(time.Millisecond)
+	filtered := testEndpoints(t, server, "logs")
+	filtered[0].Filter = `message_type == "OUT"`
+	assert.NoError(t, filtered[0].validate())
+	assert.NoError(t, endpoints.reload(filtered))
+	<-done
+
+	assert.True(t, before != endpoints.appenders()[0], "the endpoint whose filter changed is replaced")
+	assert.True(t, endpoints.shutdown(5*time.Second))
+	assert.Eventually(t, func() bool { return !before.Running() }, 5*time.Second, 10*time.Millisecond, "the previous appender is drained")
+	assert.Equal(t, int64(routed), atomic.LoadInt64(&lines), "every event is posted by the previous or the new appender")
+}
+
+func TestShutdownDrainsEndpoints(t *testing.T) {
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+	}))
+	defer server.Close()
+	endpoints := newEndpointSet(eventQueue.DropNewest)
+	assert.NoError(t, endpoints.start(testEndpoints(t, server, "logs")))
+	endpoints.queues()[0].Push(&events.Event{Fields: map[string]interface{}{}, Msg: "queued", Type: "LogMessage"})
+
+	assert.True(t, endpoints.shutdown(time.Second))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&posts), "the queued events are sent")
+	assert.False(t, endpoints.appenders()[0].Running())
+	assert.Error(t, endpoints.reload(testEndpoints(t, server, "logs")), "no reload while shutting down")
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	endpoints := newEndpointSet(eventQueue.DropNewest)
+	assert.NoError(t, endpoints.start(testEndpoints(t, server, "logs")))
+	endpoints.queues()[0].Push(&events.Event{Fields: map[string]interface{}{}, Msg: "stuck", Type: "LogMessage"})
+
+	start := time.Now()
+	assert.False(t, endpoints.shutdown(50*time.Millisecond))
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -1,13 +1,54 @@
 package eventQueue
 
-import . "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+)
+
+// OverflowPolicy tells what a bounded queue does with an event pushed while it
+// is full.
+type OverflowPolicy string
+
+const (
+	// DropNewest discards the pushed event.
+	DropNewest OverflowPolicy = "drop-newest"
+	// DropOldest discards the events at the head of the queue until the pushed
+	// event fits.
+	DropOldest OverflowPolicy = "drop-oldest"
+	// Block waits for the appender to pop events, which slows down the
+	// firehose reader.
+	Block OverflowPolicy = "block"
+)
+
+// ParseOverflowPolicy validates the name of an overflow policy.
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch OverflowPolicy(policy) {
+	case DropNewest, DropOldest, Block:
+		return OverflowPolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown queue overflow policy %q, valid options are %s, %s and %s", policy, DropNewest, DropOldest, Block)
+}
 
 // Queue is a basic FIFO queue based on a circular list that resizes as needed.
+// It is safe for concurrent use, and is bounded when created with
+// NewBoundedQueue.
 type Queue struct {
-	Events []*Event
-	head   int
-	tail   int
-	count  int
+	Events    []*Event
+	head      int
+	tail      int
+	count     int
+	bytes     int
+	maxEvents int
+	maxBytes  int
+	overflow  OverflowPolicy
+	dropped   uint64
+	closed    bool
+	mutex     sync.Mutex
+	notFull   *sync.Cond
+	notEmpty  *sync.Cond
 }
 
 func NewQueue(n []*Event) Queue {
@@ -16,21 +57,70 @@ func NewQueue(n []*Event) Queue {
 	}
 }
 
+// NewBoundedQueue returns a queue holding at most maxEvents events and
+// maxBytes bytes of events, 0 meaning no limit.
+func NewBoundedQueue(n []*Event, maxEvents int, maxBytes int, overflow OverflowPolicy) *Queue {
+	return &Queue{
+		Events:    n,
+		maxEvents: maxEvents,
+		maxBytes:  maxBytes,
+		overflow:  overflow,
+	}
+}
+
 func (q *Queue) GetNode() []*Event {
 	return q.Events
 }
 
 func (q *Queue) GetCount() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 	return q.count
 }
 
+// GetDropped returns the number of events discarded because the queue was full.
+func (q *Queue) GetDropped() uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped
+}
+
 /*
 func (q *Queue) GetEvents() Event {
 	return q.Events
 }*/
 
-// Push adds a node to the queue.
+// Push adds a node to the queue. The events pushed to a closed queue are
+// dropped, as no appender pops them any more.
 func (q *Queue) Push(n *Event) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	size := eventSize(n)
+	if q.closed {
+		q.dropped++
+		return
+	}
+	for q.full(size) {
+		if q.closed {
+			q.dropped++
+			return
+		}
+		switch q.overflow {
+		case DropOldest:
+			q.pop()
+			q.dropped++
+		case Block:
+			q.cond().Wait()
+		default:
+			q.dropped++
+			return
+		}
+	}
+
+	if len(q.Events) == 0 {
+		q.Events = make([]*Event, 1)
+	}
 	if q.head == q.tail && q.count > 0 {
 		events := make([]*Event, len(q.Events)*2)
 		copy(events, q.Events[q.head:])
@@ -42,15 +132,108 @@ func (q *Queue) Push(n *Event) {
 	q.Events[q.tail] = n
 	q.tail = (q.tail + 1) % len(q.Events)
 	q.count++
+	q.bytes += size
+	if q.notEmpty != nil {
+		q.notEmpty.Broadcast()
+	}
 }
 
 // Pop removes and returns a node from the queue in first to last order.
 func (q *Queue) Pop() *Event {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.popAndNotify()
+}
+
+// PopWait removes and returns a node from the queue, waiting until one is
+// pushed or until deadline. It returns nil when the deadline is reached, or
+// right away when the queue is closed and empty.
+func (q *Queue) PopWait(deadline time.Time) *Event {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.count == 0 && !q.closed {
+		if q.notEmpty == nil {
+			q.notEmpty = sync.NewCond(&q.mutex)
+		}
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			q.mutex.Lock()
+			defer q.mutex.Unlock()
+			q.notEmpty.Broadcast()
+		})
+		defer timer.Stop()
+		for q.count == 0 && !q.closed && time.Now().Before(deadline) {
+			q.notEmpty.Wait()
+		}
+	}
+	return q.popAndNotify()
+}
+
+// Close wakes up the callers of PopWait, which stop waiting for events once the
+// queue is empty. The events left can still be popped, the events pushed
+// afterwards are dropped.
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	if q.notEmpty != nil {
+		q.notEmpty.Broadcast()
+	}
+	if q.notFull != nil {
+		q.notFull.Broadcast()
+	}
+}
+
+func (q *Queue) popAndNotify() *Event {
+	node := q.pop()
+	if node != nil && q.notFull != nil {
+		q.notFull.Broadcast()
+	}
+	return node
+}
+
+func (q *Queue) pop() *Event {
 	if q.count == 0 {
 		return nil
 	}
 	node := q.Events[q.head]
+	q.Events[q.head] = nil
 	q.head = (q.head + 1) % len(q.Events)
 	q.count--
+	q.bytes -= eventSize(node)
 	return node
 }
+
+// full tells whether an event of the given size does not fit in the queue. An
+// empty queue always accepts an event, whatever its size.
+func (q *Queue) full(size int) bool {
+	if q.count == 0 {
+		return false
+	}
+	return (q.maxEvents > 0 && q.count >= q.maxEvents) ||
+		(q.maxBytes > 0 && q.bytes+size > q.maxBytes)
+}
+
+func (q *Queue) cond() *sync.Cond {
+	if q.notFull == nil {
+		q.notFull = sync.NewCond(&q.mutex)
+	}
+	return q.notFull
+}
+
+// eventSize estimates the memory held by an event, from its message and the
+// length of its field names and string values.
+func eventSize(event *Event) int {
+	if event == nil {
+		return 0
+	}
+	size := len(event.Msg)
+	for key, value := range event.Fields {
+		size += len(key)
+		if s, ok := value.(string); ok {
+			size += len(s)
+		} else {
+			size += 8
+		}
+	}
+	return size
+}
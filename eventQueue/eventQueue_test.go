@@ -1,7 +1,11 @@
 package eventQueue
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
 	"github.com/stretchr/testify/assert"
@@ -45,3 +49,197 @@ func TestQueueFIFO(t *testing.T) {
 	assert.Equal(queue.Pop().Msg, "index [02]", "")
 	assert.Equal(queue.Pop().Msg, "index [03]", "")
 }
+
+func newEvent(msg string) *Event {
+	return &Event{Fields: map[string]interface{}{}, Msg: msg}
+}
+
+func TestQueueGrowsUnbounded(t *testing.T) {
+	queue := NewQueue(make([]*Event, 2))
+
+	for i := 0; i < 5; i++ {
+		queue.Push(newEvent(fmt.Sprintf("%d", i)))
+	}
+
+	assert.Equal(t, 5, queue.GetCount())
+	assert.Equal(t, "0", queue.Pop().Msg)
+	assert.Equal(t, uint64(0), queue.GetDropped())
+}
+
+func TestBoundedQueueDropNewest(t *testing.T) {
+	queue := NewBoundedQueue(make([]*Event, 2), 3, 0, DropNewest)
+
+	for i := 0; i < 5; i++ {
+		queue.Push(newEvent(fmt.Sprintf("%d", i)))
+	}
+
+	assert.Equal(t, 3, queue.GetCount())
+	assert.Equal(t, uint64(2), queue.GetDropped())
+	assert.Equal(t, "0", queue.Pop().Msg)
+	assert.Equal(t, "1", queue.Pop().Msg)
+	assert.Equal(t, "2", queue.Pop().Msg)
+	assert.Nil(t, queue.Pop())
+}
+
+func TestBoundedQueueDropOldest(t *testing.T) {
+	queue := NewBoundedQueue(make([]*Event, 2), 3, 0, DropOldest)
+
+	for i := 0; i < 5; i++ {
+		queue.Push(newEvent(fmt.Sprintf("%d", i)))
+	}
+
+	assert.Equal(t, 3, queue.GetCount())
+	assert.Equal(t, uint64(2), queue.GetDropped())
+	assert.Equal(t, "2", queue.Pop().Msg)
+	assert.Equal(t, "3", queue.Pop().Msg)
+	assert.Equal(t, "4", queue.Pop().Msg)
+}
+
+func TestBoundedQueueMaxBytes(t *testing.T) {
+	queue := NewBoundedQueue(make([]*Event, 2), 0, 25, DropOldest)
+
+	queue.Push(newEvent("0123456789"))
+	queue.Push(newEvent("0123456789"))
+	queue.Push(newEvent("abcdefghij"))
+
+	assert.Equal(t, 2, queue.GetCount())
+	assert.Equal(t, uint64(1), queue.GetDropped())
+
+	queue.Pop()
+	queue.Pop()
+	queue.Push(newEvent(strings.Repeat("x", 100)))
+	assert.Equal(t, 1, queue.GetCount(), "an empty queue accepts an event larger than the limit")
+}
+
+func TestBoundedQueueBlock(t *testing.T) {
+	queue := NewBoundedQueue(make([]*Event, 2), 2, 0, Block)
+	queue.Push(newEvent("0"))
+	queue.Push(newEvent("1"))
+
+	pushed := make(chan bool)
+	go func() {
+		queue.Push(newEvent("2"))
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, "0", queue.Pop().Msg)
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("push was not released by pop")
+	}
+	assert.Equal(t, 2, queue.GetCount())
+	assert.Equal(t, uint64(0), queue.GetDropped())
+}
+
+func TestQueueConcurrentPushPop(t *testing.T) {
+	queue := NewBoundedQueue(make([]*Event, 10), 100, 0, Block)
+	var wg sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				queue.Push(newEvent("event"))
+			}
+		}()
+	}
+
+	popped := 0
+	for popped < 4000 {
+		if queue.Pop() != nil {
+			popped++
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, 0, queue.GetCount())
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	policy, err := ParseOverflowPolicy("block")
+	assert.NoError(t, err)
+	assert.Equal(t, Block, policy)
+
+	_, err = ParseOverflowPolicy("drop-everything")
+	assert.Error(t, err)
+}
+
+func TestPopWaitReturnsPushedEvent(t *testing.T) {
+	queue := NewBoundedQueue(make([]*Event, 2), 0, 0, DropNewest)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		queue.Push(newEvent("pushed"))
+	}()
+
+	start := time.Now()
+	event := queue.PopWait(start.Add(time.Second))
+
+	assert.Equal(t, "pushed", event.Msg)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestPopWaitDeadline(t *testing.T) {
+	queue := NewBoundedQueue(make([]*Event, 2), 0, 0, DropNewest)
+
+	start := time.Now()
+	assert.Nil(t, queue.PopWait(start.Add(30*time.Millisecond)))
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+
+	queue.Push(newEvent("queued"))
+	assert.Equal(t, "queued", queue.PopWait(start).Msg, "a queued event is returned even past the deadline")
+}
+
+func TestCloseWakesPopWait(t *testing.T) {
+	queue := NewBoundedQueue(make([]*Event, 2), 0, 0, DropNewest)
+	queue.Push(newEvent("queued"))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		queue.Close()
+	}()
+
+	start := time.Now()
+	assert.Equal(t, "queued", queue.PopWait(start.Add(time.Second)).Msg, "the queued events are drained")
+	assert.Nil(t, queue.PopWait(start.Add(time.Second)))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Nil(t, queue.PopWait(time.Now().Add(time.Second)), "a closed queue does not wait")
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestPushToClosedQueueIsDropped(t *testing.T) {
+	queue := NewBoundedQueue(make([]*Event, 1), 1, 0, Block)
+	queue.Push(newEvent("queued"))
+	pushed := make(chan struct{})
+	go func() {
+		queue.Push(newEvent("blocked"))
+		close(pushed)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	queue.Close()
+	<-pushed
+	queue.Push(newEvent("after close"))
+	assert.Equal(t, 1, queue.GetCount())
+	assert.Equal(t, uint64(2), queue.GetDropped(), "the blocked push is released and both pushes are dropped")
+	assert.Equal(t, "queued", queue.Pop().Msg)
+}
+
+func BenchmarkQueuePushPopWait(b *testing.B) {
+	queue := NewBoundedQueue(make([]*Event, 100), 100000, 0, Block)
+	event := newEvent("benchmark")
+	go func() {
+		for i := 0; i < b.N; i++ {
+			queue.Push(event)
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queue.PopWait(time.Now().Add(time.Second))
+	}
+}
@@ -0,0 +1,98 @@
+package eventRouting
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	fevents "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const droppedMessagesCounter = "TruncatingBuffer.DroppedMessages"
+
+// droppedMessages accumulates the messages that each doppler reports as dropped
+// because the nozzle, or the traffic controller, is not keeping up.
+type droppedMessages struct {
+	mutex    *sync.Mutex
+	dopplers map[string]*dopplerDrops
+}
+
+type dopplerDrops struct {
+	deployment string
+	job        string
+	jobIndex   string
+	ip         string
+	total      uint64
+	delta      uint64
+}
+
+func newDroppedMessages() *droppedMessages {
+	return &droppedMessages{
+		mutex:    &sync.Mutex{},
+		dopplers: make(map[string]*dopplerDrops),
+	}
+}
+
+// IsDroppedMessagesCounter reports whether the envelope is the doppler counter
+// of messages dropped on their way to the nozzle.
+func IsDroppedMessagesCounter(msg *events.Envelope) bool {
+	return msg.GetEventType() == events.Envelope_CounterEvent &&
+		msg.GetCounterEvent().GetName() == droppedMessagesCounter &&
+		msg.GetOrigin() == "doppler"
+}
+
+func (d *droppedMessages) record(msg *events.Envelope) {
+	key := msg.GetJob() + "/" + msg.GetIndex()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	doppler, found := d.dopplers[key]
+	if !found {
+		doppler = &dopplerDrops{
+			deployment: msg.GetDeployment(),
+			job:        msg.GetJob(),
+			jobIndex:   msg.GetIndex(),
+			ip:         msg.GetIp(),
+		}
+		d.dopplers[key] = doppler
+	}
+	doppler.total += msg.GetCounterEvent().GetDelta()
+	doppler.delta += msg.GetCounterEvent().GetDelta()
+}
+
+// report returns one nozzle self-metric per doppler with the messages dropped
+// since start and since the previous report, and the total of the latter.
+func (d *droppedMessages) report(now time.Time) ([]*fevents.Event, uint64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	keys := make([]string, 0, len(d.dopplers))
+	for key := range d.dopplers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	reportEvents := []*fevents.Event{}
+	dropped := uint64(0)
+	for _, key := range keys {
+		doppler := d.dopplers[key]
+		reportEvents = append(reportEvents, &fevents.Event{
+			Fields: fevents.Fields{
+				"deployment": doppler.deployment,
+				"ip":         doppler.ip,
+				"job":        doppler.job,
+				"job_index":  doppler.jobIndex,
+				"name":       "sumo_nozzle.doppler.dropped_messages",
+				"origin":     "sumologic-cloudfoundry-nozzle",
+				"timestamp":  now.UnixNano(),
+				"delta":      doppler.delta,
+				"total":      doppler.total,
+			},
+			Msg:  "",
+			Type: "CounterEvent",
+		})
+		dropped += doppler.delta
+		doppler.delta = 0
+	}
+	return reportEvents, dropped
+}
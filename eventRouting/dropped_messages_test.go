@@ -0,0 +1,70 @@
+package eventRouting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/caching"
+)
+
+func newDroppedMessagesEnvelope(index string, delta uint64) *events.Envelope {
+	return &events.Envelope{
+		Origin:     proto.String("doppler"),
+		EventType:  events.Envelope_CounterEvent.Enum(),
+		Deployment: proto.String("cf"),
+		Job:        proto.String("doppler"),
+		Index:      proto.String(index),
+		Ip:         proto.String("10.0.0." + index),
+		CounterEvent: &events.CounterEvent{
+			Name:  proto.String(droppedMessagesCounter),
+			Delta: proto.Uint64(delta),
+		},
+	}
+}
+
+func TestIsDroppedMessagesCounter(t *testing.T) {
+	assert.True(t, IsDroppedMessagesCounter(newDroppedMessagesEnvelope("0", 1)))
+
+	other := newDroppedMessagesEnvelope("0", 1)
+	other.Origin = proto.String("MetronAgent")
+	assert.False(t, IsDroppedMessagesCounter(other))
+}
+
+func TestDroppedMessagesReport(t *testing.T) {
+	dropped := newDroppedMessages()
+	dropped.record(newDroppedMessagesEnvelope("1", 10))
+	dropped.record(newDroppedMessagesEnvelope("0", 5))
+	dropped.record(newDroppedMessagesEnvelope("1", 7))
+
+	reportEvents, total := dropped.report(time.Now())
+	assert.Equal(t, uint64(22), total)
+	assert.Len(t, reportEvents, 2)
+	assert.Equal(t, "CounterEvent", reportEvents[0].Type)
+	assert.Equal(t, "0", reportEvents[0].Fields["job_index"])
+	assert.Equal(t, uint64(5), reportEvents[0].Fields["total"])
+	assert.Equal(t, uint64(17), reportEvents[1].Fields["total"])
+	assert.Equal(t, uint64(17), reportEvents[1].Fields["delta"])
+
+	dropped.record(newDroppedMessagesEnvelope("1", 3))
+	reportEvents, total = dropped.report(time.Now())
+	assert.Equal(t, uint64(3), total)
+	assert.Equal(t, uint64(0), reportEvents[0].Fields["delta"])
+	assert.Equal(t, uint64(20), reportEvents[1].Fields["total"])
+	assert.Equal(t, uint64(3), reportEvents[1].Fields["delta"])
+}
+
+func TestStopEndsDroppedMessagesReport(t *testing.T) {
+	routing := NewEventRouting(caching.NewCachingEmpty(), newRoutingQueues(1))
+	assert.NoError(t, routing.SetupEventRouting("LogMessage"))
+	routing.SetupDroppedMessagesReport(time.Millisecond)
+
+	routing.Stop()
+	routing.RecordDroppedMessages(newDroppedMessagesEnvelope("0", 5))
+	time.Sleep(20 * time.Millisecond)
+	_, total := routing.droppedMessages.report(time.Now())
+	assert.Equal(t, uint64(5), total, "the drops recorded after Stop are not reported")
+}
@@ -5,28 +5,47 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/caching"
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventQueue"
 	fevents "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
 type EventRouting struct {
 	CachingClient       caching.Caching
 	selectedEvents      map[string]bool
+	defaultEvents       map[string]bool
+	queueEvents         []map[string]bool
 	selectedEventsCount map[string]uint64
 	mutex               *sync.Mutex
+	pushing             *sync.RWMutex
 	queues              []*eventQueue.Queue
+	httpPairing         *httpPairing
+	pairingTicker       *time.Ticker
+	reportTicker        *time.Ticker
+	stopped             chan struct{}
+	tickers             *sync.WaitGroup
+	tagsConfig          *fevents.TagsConfig
+	droppedMessages     *droppedMessages
+	reportsDropped      bool
 }
 
 func NewEventRouting(caching caching.Caching, queues []*eventQueue.Queue) *EventRouting {
 	return &EventRouting{
 		CachingClient:       caching,
 		selectedEvents:      make(map[string]bool),
+		defaultEvents:       make(map[string]bool),
 		selectedEventsCount: make(map[string]uint64),
 		queues:              queues,
 		mutex:               &sync.Mutex{},
+		pushing:             &sync.RWMutex{},
+		stopped:             make(chan struct{}),
+		tickers:             &sync.WaitGroup{},
+		tagsConfig:          fevents.NewTagsConfig("", "", ""),
+		droppedMessages:     newDroppedMessages(),
 	}
 }
 
@@ -34,6 +53,18 @@ func (e *EventRouting) GetSelectedEvents() map[string]bool {
 	return e.selectedEvents
 }
 
+// GetSelectedEventsCount returns a copy of the number of events routed by type,
+// along with the "ignored_app_message" count of events of opted-out apps.
+func (e *EventRouting) GetSelectedEventsCount() map[string]uint64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	counts := make(map[string]uint64, len(e.selectedEventsCount))
+	for eventType, count := range e.selectedEventsCount {
+		counts[eventType] = count
+	}
+	return counts
+}
+
 func (e *EventRouting) RouteEvent(msg *events.Envelope) {
 
 	eventType := msg.GetEventType()
@@ -52,52 +83,360 @@ func (e *EventRouting) RouteEvent(msg *events.Envelope) {
 			event = fevents.ErrorEvent(msg)
 		case events.Envelope_ContainerMetric:
 			event = fevents.ContainerMetric(msg)
+		case events.Envelope_HttpStart:
+			event = fevents.HttpStart(msg)
+		case events.Envelope_HttpStop:
+			event = fevents.HttpStop(msg)
+		default:
+			return
 		}
 
 		event.AnnotateWithEnveloppeData(msg)
+		event.AnnotateWithTags(msg.GetTags(), e.tagsConfig)
+		if e.httpPairing != nil && (eventType == events.Envelope_HttpStart || eventType == events.Envelope_HttpStop) && event.Fields["request_id"] != "" {
+			paired, unpaired := e.httpPairing.pair(event, time.Now())
+			if unpaired != nil {
+				e.routeEvent(unpaired.Type, unpaired)
+			}
+			if paired != nil {
+				e.routeEvent(paired.Type, paired, "HttpStart", "HttpStop")
+			}
+			return
+		}
+		e.routeEvent(eventType.String(), event)
+	}
+}
+
+// RecordDroppedMessages accumulates a doppler TruncatingBuffer.DroppedMessages counter.
+func (e *EventRouting) RecordDroppedMessages(msg *events.Envelope) {
+	e.droppedMessages.record(msg)
+}
 
-		if _, hasAppId := event.Fields["cf_app_id"]; hasAppId {
-			event.AnnotateWithAppData(e.CachingClient)
+// SetupDroppedMessagesReport periodically sends the messages dropped by each
+// doppler as nozzle self-metrics and logs a warning when messages were dropped.
+func (e *EventRouting) SetupDroppedMessagesReport(period time.Duration) {
+	e.reportsDropped = true
+	e.reportTicker = time.NewTicker(period)
+	e.tickers.Add(1)
+	go func() {
+		defer e.tickers.Done()
+		for {
+			var now time.Time
+			select {
+			case now = <-e.reportTicker.C:
+			case <-e.stopped:
+				return
+			}
+			reportEvents, dropped := e.droppedMessages.report(now)
+			if dropped > 0 {
+				logging.Warning.Printf("Dopplers dropped %d messages in the last %v (%.1f messages/s). The nozzle is not keeping up, please try scaling up the nozzle.",
+					dropped, period, float64(dropped)/period.Seconds())
+			}
+			e.pushing.RLock()
+			e.mutex.Lock()
+			queues, queueEvents := e.queues, e.queueEvents
+			e.mutex.Unlock()
+			for _, event := range reportEvents {
+				for i, queue := range queues {
+					if i >= len(queueEvents) || queueEvents[i] == nil || queueEvents[i][event.Type] {
+						queue.Push(event)
+					}
+				}
+			}
+			e.pushing.RUnlock()
 		}
+	}()
+}
 
-		e.mutex.Lock()
-		//We do not ship Event
-		if ignored, hasIgnoredField := event.Fields["cf_ignored_app"]; ignored == true && hasIgnoredField {
-			e.selectedEventsCount["ignored_app_message"]++
-		} else {
-			//Push the event to the queue
-			for _, queue := range e.queues {
-				queue.Push(event)
+// ReportsDroppedMessages reports whether the messages dropped by the dopplers
+// are reported, which needs their counters from the firehose.
+func (e *EventRouting) ReportsDroppedMessages() bool {
+	return e.reportsDropped
+}
+
+// SetupTagsPropagation sets which envelope tags are added to the event fields,
+// and the prefix of their field names.
+func (e *EventRouting) SetupTagsPropagation(prefix string, include string, exclude string) {
+	e.tagsConfig = fevents.NewTagsConfig(prefix, include, exclude)
+}
+
+// SetupHttpPairing holds HttpStart and HttpStop events so that both halves of a
+// request seen within the window are shipped as a single HttpStartStop event.
+// Halves left unpaired when the window expires are shipped as they are.
+func (e *EventRouting) SetupHttpPairing(window time.Duration) {
+	e.httpPairing = newHttpPairing(window)
+	e.pairingTicker = time.NewTicker(window)
+	e.tickers.Add(1)
+	go func() {
+		defer e.tickers.Done()
+		for {
+			select {
+			case now := <-e.pairingTicker.C:
+				for _, event := range e.httpPairing.expired(now) {
+					e.routeEvent(event.Type, event)
+				}
+			case <-e.stopped:
+				return
 			}
-			e.selectedEventsCount[eventType.String()]++
 		}
+	}()
+}
+
+// Stop stops the periodic routing of the dropped messages report and of the
+// expired HttpStart and HttpStop halves, routes the halves still held for
+// pairing, unpaired, then waits for the events being pushed and stops routing
+// events to the queues so that they can be drained. It must be called once,
+// when no more envelopes are routed.
+func (e *EventRouting) Stop() {
+	if e.pairingTicker != nil {
+		e.pairingTicker.Stop()
+	}
+	if e.reportTicker != nil {
+		e.reportTicker.Stop()
+	}
+	close(e.stopped)
+	e.tickers.Wait()
+	if e.httpPairing != nil {
+		for _, event := range e.httpPairing.expired(time.Now().Add(e.httpPairing.window)) {
+			e.routeEvent(event.Type, event)
+		}
+	}
+	e.pushing.Lock()
+	e.mutex.Lock()
+	e.queues = nil
+	e.mutex.Unlock()
+	e.pushing.Unlock()
+}
+
+// RouteEnvelopeV2 routes a loggregator v2 envelope received from the RLP gateway.
+// Timers and gauges are routed as Timer and Gauge events to the queues
+// selecting them, and as the v1 event type they map to to the other queues.
+func (e *EventRouting) RouteEnvelopeV2(env *fevents.EnvelopeV2) {
+	var representations []v2Representation
+	switch {
+	case env.Log != nil:
+		representations = []v2Representation{{"LogMessage", "", func() []*fevents.Event { return []*fevents.Event{fevents.LogMessageV2(env)} }}}
+	case env.Counter != nil:
+		representations = []v2Representation{{"CounterEvent", "", func() []*fevents.Event { return []*fevents.Event{fevents.CounterEventV2(env)} }}}
+	case env.IsContainerMetric():
+		representations = []v2Representation{
+			{"Gauge", "", func() []*fevents.Event { return []*fevents.Event{fevents.Gauge(env)} }},
+			{"ContainerMetric", "Gauge", func() []*fevents.Event { return []*fevents.Event{fevents.ContainerMetricV2(env)} }},
+		}
+	case env.Gauge != nil:
+		representations = []v2Representation{
+			{"Gauge", "", func() []*fevents.Event { return []*fevents.Event{fevents.Gauge(env)} }},
+			{"ValueMetric", "Gauge", func() []*fevents.Event { return fevents.ValueMetricsV2(env) }},
+		}
+	case env.Timer != nil:
+		representations = []v2Representation{
+			{"Timer", "", func() []*fevents.Event { return []*fevents.Event{fevents.Timer(env)} }},
+			{"HttpStartStop", "Timer", func() []*fevents.Event { return []*fevents.Event{fevents.HttpStartStopV2(env)} }},
+		}
+	case env.Event != nil:
+		representations = []v2Representation{{"LogMessage", "", func() []*fevents.Event { return []*fevents.Event{fevents.PlatformEventV2(env)} }}}
+	default:
+		return
+	}
+
+	tags := env.AllTags()
+	for _, representation := range representations {
+		if !e.selectedEvents[representation.eventType] {
+			continue
+		}
+		if representation.preferred != "" && !e.anyQueueSelects(representation.eventType, representation.preferred) {
+			continue
+		}
+		for _, event := range representation.build() {
+			event.AnnotateWithEnvelopeV2Data(env, representation.eventType)
+			event.AnnotateWithTags(tags, e.tagsConfig)
+			e.route(representation.eventType, event, representation.preferred, nil)
+		}
+	}
+}
+
+// v2Representation is an event type a loggregator v2 envelope is routed as.
+// The queues selecting the preferred type, if any, only get that one.
+type v2Representation struct {
+	eventType string
+	preferred string
+	build     func() []*fevents.Event
+}
+
+// anyQueueSelects reports whether a queue selects the event type without
+// selecting the preferred type.
+func (e *EventRouting) anyQueueSelects(eventType string, preferred string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for i := range e.queues {
+		if e.queueSelects(i, eventType, preferred, nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeEvent pushes an event to the queues selecting its type, or one of the
+// alternative types when it is made of events of these types.
+func (e *EventRouting) routeEvent(eventType string, event *fevents.Event, alternativeTypes ...string) {
+	e.route(eventType, event, "", alternativeTypes)
+}
+
+// route pushes an event to the queues selecting its type, or one of the
+// alternative types, but not the preferred type.
+func (e *EventRouting) route(eventType string, event *fevents.Event, preferred string, alternativeTypes []string) {
+	if _, hasAppId := event.Fields["cf_app_id"]; hasAppId {
+		event.AnnotateWithAppData(e.CachingClient)
+	}
+
+	e.pushing.RLock()
+	defer e.pushing.RUnlock()
+	e.mutex.Lock()
+	//We do not ship Event
+	if ignored, hasIgnoredField := event.Fields["cf_ignored_app"]; ignored == true && hasIgnoredField {
+		e.selectedEventsCount["ignored_app_message"]++
 		e.mutex.Unlock()
+		return
+	}
+	var selecting []*eventQueue.Queue
+	for i, queue := range e.queues {
+		if e.queueSelects(i, eventType, preferred, alternativeTypes) {
+			selecting = append(selecting, queue)
+		}
+	}
+	e.selectedEventsCount[eventType]++
+	e.mutex.Unlock()
+
+	//Push the event to the queues selecting it, without holding the mutex as
+	//a full queue blocks the push with the block overflow policy. The queues
+	//are only replaced once the pushes to them are done
+	for _, queue := range selecting {
+		queue.Push(event)
 	}
 }
 
+func (e *EventRouting) queueSelects(queue int, eventType string, preferred string, alternativeTypes []string) bool {
+	selected := e.defaultEvents
+	if queue < len(e.queueEvents) && e.queueEvents[queue] != nil {
+		selected = e.queueEvents[queue]
+	}
+	if preferred != "" && selected[preferred] {
+		return false
+	}
+	if selected[eventType] {
+		return true
+	}
+	for _, alternativeType := range alternativeTypes {
+		if selected[alternativeType] {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *EventRouting) SetupEventRouting(wantedEvents string) error {
+	selectedEvents := map[string]bool{"LogMessage": true}
+	if wantedEvents != "" {
+		var err error
+		selectedEvents, err = ParseEvents(wantedEvents)
+		if err != nil {
+			return err
+		}
+	}
 	e.selectedEvents = make(map[string]bool)
-	if wantedEvents == "" {
-		e.selectedEvents["LogMessage"] = true
-	} else {
-		for _, event := range strings.Split(wantedEvents, ",") {
-			if e.isAuthorizedEvent(strings.TrimSpace(event)) {
-				e.selectedEvents[strings.TrimSpace(event)] = true
-				//logging.LogStd(fmt.Sprintf("Event Type [%s] is included in the fireshose!", event), false)
-			} else {
-				return fmt.Errorf("Rejected Event Name [%s] - Valid events: %s", event, GetListAuthorizedEventEvents())
+	e.defaultEvents = selectedEvents
+	for event := range selectedEvents {
+		e.selectedEvents[event] = true
+	}
+	return nil
+}
+
+// SetupQueueEvents routes to each queue only the events of its comma separated
+// list of event types. The queues with an empty list receive the events of
+// SetupEventRouting, which must be called first.
+func (e *EventRouting) SetupQueueEvents(queueEvents []string) error {
+	parsed, err := parseQueueEvents(queueEvents)
+	if err != nil {
+		return err
+	}
+	e.queueEvents = parsed
+	for _, selectedEvents := range parsed {
+		for event := range selectedEvents {
+			e.selectedEvents[event] = true
+		}
+	}
+	return nil
+}
+
+// ReplaceQueues routes the events to new queues, with their lists of event
+// types as for SetupQueueEvents. These event types must already be selected,
+// as the events read from the firehose do not change. It waits for the events
+// being pushed to the previous queues, which receive no more events once it
+// returns.
+func (e *EventRouting) ReplaceQueues(queues []*eventQueue.Queue, queueEvents []string) error {
+	parsed, err := parseQueueEvents(queueEvents)
+	if err != nil {
+		return err
+	}
+	for _, selectedEvents := range parsed {
+		for event := range selectedEvents {
+			if !e.selectedEvents[event] {
+				return fmt.Errorf("Event Name [%s] is not read from the firehose, the nozzle must be restarted to select it", event)
 			}
 		}
 	}
+	e.pushing.Lock()
+	e.mutex.Lock()
+	e.queues = queues
+	e.queueEvents = parsed
+	e.mutex.Unlock()
+	e.pushing.Unlock()
 	return nil
 }
 
-func (e *EventRouting) isAuthorizedEvent(wantedEvent string) bool {
+func parseQueueEvents(queueEvents []string) ([]map[string]bool, error) {
+	parsed := make([]map[string]bool, len(queueEvents))
+	for i, wantedEvents := range queueEvents {
+		if strings.TrimSpace(wantedEvents) == "" {
+			continue
+		}
+		selectedEvents, err := ParseEvents(wantedEvents)
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = selectedEvents
+	}
+	return parsed, nil
+}
+
+// ParseEvents parses a comma separated list of event types.
+func ParseEvents(wantedEvents string) (map[string]bool, error) {
+	selectedEvents := make(map[string]bool)
+	for _, event := range strings.Split(wantedEvents, ",") {
+		if isAuthorizedEvent(strings.TrimSpace(event)) {
+			selectedEvents[strings.TrimSpace(event)] = true
+			//logging.LogStd(fmt.Sprintf("Event Type [%s] is included in the fireshose!", event), false)
+		} else {
+			return nil, fmt.Errorf("Rejected Event Name [%s] - Valid events: %s", event, GetListAuthorizedEventEvents())
+		}
+	}
+	return selectedEvents, nil
+}
+
+// v2EventTypes are the event types that only the RLP gateway ingestion mode produces.
+var v2EventTypes = []string{"Gauge", "Timer"}
+
+func isAuthorizedEvent(wantedEvent string) bool {
 	for _, authorizeEvent := range events.Envelope_EventType_name {
 		if wantedEvent == authorizeEvent {
 			return true
 		}
 	}
+	for _, authorizeEvent := range v2EventTypes {
+		if wantedEvent == authorizeEvent {
+			return true
+		}
+	}
 	return false
 }
 
@@ -106,6 +445,7 @@ func GetListAuthorizedEventEvents() (authorizedEvents string) {
 	for _, listEvent := range events.Envelope_EventType_name {
 		arrEvents = append(arrEvents, listEvent)
 	}
+	arrEvents = append(arrEvents, v2EventTypes...)
 	sort.Strings(arrEvents)
 	return strings.Join(arrEvents, ", ")
 }
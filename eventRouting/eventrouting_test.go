@@ -0,0 +1,236 @@
+package eventRouting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/caching"
+	. "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventQueue"
+	fevents "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+)
+
+func newRoutingQueues(n int) []*Queue {
+	queues := make([]*Queue, n)
+	for i := range queues {
+		queue := NewQueue(make([]*fevents.Event, 10))
+		queues[i] = &queue
+	}
+	return queues
+}
+
+func TestRouteEventToQueuesSelectingItsType(t *testing.T) {
+	queues := newRoutingQueues(3)
+	routing := NewEventRouting(caching.NewCachingEmpty(), queues)
+	assert.NoError(t, routing.SetupEventRouting("LogMessage"))
+	assert.NoError(t, routing.SetupQueueEvents([]string{"LogMessage,Error", "ValueMetric, CounterEvent", ""}))
+	assert.Equal(t, map[string]bool{"LogMessage": true, "Error": true, "ValueMetric": true, "CounterEvent": true}, routing.GetSelectedEvents())
+
+	routing.RouteEvent(&events.Envelope{
+		Origin:    proto.String("gorouter"),
+		EventType: events.Envelope_ValueMetric.Enum(),
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String("latency"),
+			Value: proto.Float64(1.5),
+			Unit:  proto.String("ms"),
+		},
+	})
+	routing.RouteEvent(&events.Envelope{
+		Origin:    proto.String("rep"),
+		EventType: events.Envelope_LogMessage.Enum(),
+		LogMessage: &events.LogMessage{
+			Message:     []byte("hello"),
+			MessageType: events.LogMessage_OUT.Enum(),
+			Timestamp:   proto.Int64(1483629662001580713),
+		},
+	})
+
+	assert.Equal(t, 1, queues[0].GetCount())
+	assert.Equal(t, "LogMessage", queues[0].Pop().Type)
+	assert.Equal(t, 1, queues[1].GetCount())
+	assert.Equal(t, "ValueMetric", queues[1].Pop().Type)
+	assert.Equal(t, 1, queues[2].GetCount(), "queues without their own types get the default ones")
+	assert.Equal(t, "LogMessage", queues[2].Pop().Type)
+}
+
+func TestRoutePairedHttpEventToQueuesSelectingAHalf(t *testing.T) {
+	queues := newRoutingQueues(2)
+	routing := NewEventRouting(caching.NewCachingEmpty(), queues)
+	assert.NoError(t, routing.SetupEventRouting("LogMessage"))
+	assert.NoError(t, routing.SetupQueueEvents([]string{"HttpStart,HttpStop", ""}))
+
+	routing.routeEvent("HttpStartStop", &fevents.Event{Fields: map[string]interface{}{}, Type: "HttpStartStop"}, "HttpStart", "HttpStop")
+
+	assert.Equal(t, 1, queues[0].GetCount())
+	assert.Equal(t, 0, queues[1].GetCount())
+}
+
+func TestSetupQueueEventsRejectsUnknownEvents(t *testing.T) {
+	routing := NewEventRouting(caching.NewCachingEmpty(), newRoutingQueues(1))
+	assert.NoError(t, routing.SetupEventRouting(""))
+	assert.Error(t, routing.SetupQueueEvents([]string{"LogMessage,Unknown"}))
+}
+
+func TestReplaceQueues(t *testing.T) {
+	queues := newRoutingQueues(2)
+	routing := NewEventRouting(caching.NewCachingEmpty(), queues[:1])
+	assert.NoError(t, routing.SetupEventRouting("LogMessage,Error"))
+	assert.NoError(t, routing.SetupQueueEvents([]string{""}))
+
+	assert.Error(t, routing.ReplaceQueues(queues[1:], []string{"ValueMetric"}), "the events read from the firehose do not change")
+	assert.NoError(t, routing.ReplaceQueues(queues[1:], []string{"Error"}))
+	routing.routeEvent("Error", &fevents.Event{Fields: map[string]interface{}{}, Type: "Error"})
+	routing.routeEvent("LogMessage", &fevents.Event{Fields: map[string]interface{}{}, Type: "LogMessage"})
+
+	assert.Equal(t, 0, queues[0].GetCount())
+	assert.Equal(t, 1, queues[1].GetCount())
+	assert.Equal(t, "Error", queues[1].Pop().Type)
+}
+
+func TestStopRoutesHeldHalvesAndDetachesQueues(t *testing.T) {
+	queues := newRoutingQueues(1)
+	routing := NewEventRouting(caching.NewCachingEmpty(), queues)
+	assert.NoError(t, routing.SetupEventRouting("HttpStart,HttpStop"))
+	routing.httpPairing = newHttpPairing(time.Hour)
+	routing.httpPairing.pair(&fevents.Event{Fields: map[string]interface{}{"request_id": "1"}, Type: "HttpStart"}, time.Now())
+
+	routing.Stop()
+	assert.Equal(t, 1, queues[0].GetCount(), "the held half is routed")
+	assert.Equal(t, "HttpStart", queues[0].Pop().Type)
+
+	routing.routeEvent("HttpStop", &fevents.Event{Fields: map[string]interface{}{}, Type: "HttpStop"})
+	assert.Equal(t, 0, queues[0].GetCount())
+}
+
+func TestStopEndsHttpPairingExpiry(t *testing.T) {
+	queues := newRoutingQueues(1)
+	routing := NewEventRouting(caching.NewCachingEmpty(), queues)
+	assert.NoError(t, routing.SetupEventRouting("HttpStart,HttpStop"))
+	routing.SetupHttpPairing(time.Millisecond)
+
+	routing.Stop()
+	routing.httpPairing.pair(&fevents.Event{Fields: map[string]interface{}{"request_id": "1"}, Type: "HttpStart"}, time.Now().Add(-time.Hour))
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, routing.GetSelectedEventsCount(), "no expired half is routed after Stop")
+}
+
+func TestRouteStandaloneHttpStartAndStop(t *testing.T) {
+	queues := newRoutingQueues(1)
+	routing := NewEventRouting(caching.NewCachingEmpty(), queues)
+	assert.NoError(t, routing.SetupEventRouting("HttpStart,HttpStop"))
+
+	requestId := &events.UUID{Low: proto.Uint64(1), High: proto.Uint64(2)}
+	routing.RouteEvent(&events.Envelope{
+		Origin:    proto.String("gorouter"),
+		EventType: events.Envelope_HttpStart.Enum(),
+		HttpStart: &events.HttpStart{
+			Timestamp: proto.Int64(1483629662001580569),
+			RequestId: requestId,
+			PeerType:  events.PeerType_Client.Enum(),
+			Method:    events.Method_GET.Enum(),
+			Uri:       proto.String("http://app.example.com/"),
+		},
+	})
+	routing.RouteEvent(&events.Envelope{
+		Origin:    proto.String("gorouter"),
+		EventType: events.Envelope_HttpStop.Enum(),
+		HttpStop: &events.HttpStop{
+			Timestamp:  proto.Int64(1483629662001680569),
+			RequestId:  requestId,
+			PeerType:   events.PeerType_Client.Enum(),
+			StatusCode: proto.Int32(200),
+			Uri:        proto.String("http://app.example.com/"),
+		},
+	})
+	// Halves without their own message, as sent by old dopplers.
+	routing.RouteEvent(&events.Envelope{Origin: proto.String("gorouter"), EventType: events.Envelope_HttpStart.Enum()})
+	routing.RouteEvent(&events.Envelope{Origin: proto.String("gorouter"), EventType: events.Envelope_HttpStop.Enum()})
+
+	assert.Equal(t, 4, queues[0].GetCount(), "the halves are routed as they are without pairing")
+	start := queues[0].Pop()
+	assert.Equal(t, "HttpStart", start.Type)
+	assert.Equal(t, "GET", start.Fields["method"])
+	assert.Equal(t, "http://app.example.com/", start.Fields["uri"])
+	stop := queues[0].Pop()
+	assert.Equal(t, "HttpStop", stop.Type)
+	assert.Equal(t, int32(200), stop.Fields["status_code"])
+	assert.Equal(t, start.Fields["request_id"], stop.Fields["request_id"])
+	assert.Equal(t, "HttpStart", queues[0].Pop().Type)
+	assert.Equal(t, "HttpStop", queues[0].Pop().Type)
+	assert.Equal(t, uint64(2), routing.GetSelectedEventsCount()["HttpStart"])
+}
+
+func TestBlockedPushDoesNotHoldTheRouting(t *testing.T) {
+	blocking := NewBoundedQueue(make([]*fevents.Event, 1), 1, 0, Block)
+	routing := NewEventRouting(caching.NewCachingEmpty(), []*Queue{blocking})
+	assert.NoError(t, routing.SetupEventRouting("LogMessage"))
+	routing.routeEvent("LogMessage", &fevents.Event{Fields: map[string]interface{}{}, Type: "LogMessage"})
+
+	pushed := make(chan struct{})
+	go func() {
+		routing.routeEvent("LogMessage", &fevents.Event{Fields: map[string]interface{}{}, Type: "LogMessage"})
+		close(pushed)
+	}()
+	assert.Eventually(t, func() bool { return routing.GetSelectedEventsCount()["LogMessage"] == 2 }, time.Second, time.Millisecond, "the counts are read while the push is blocked")
+
+	replaced := make(chan struct{})
+	go func() {
+		assert.NoError(t, routing.ReplaceQueues(newRoutingQueues(1), []string{""}))
+		close(replaced)
+	}()
+	select {
+	case <-replaced:
+		t.Fatal("the queues were replaced before the push to the previous ones was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	blocking.Pop()
+	<-pushed
+	<-replaced
+	assert.Equal(t, 1, blocking.GetCount())
+}
+
+func TestRouteEnvelopeV2PerQueueRepresentation(t *testing.T) {
+	queues := newRoutingQueues(4)
+	routing := NewEventRouting(caching.NewCachingEmpty(), queues)
+	assert.NoError(t, routing.SetupEventRouting("LogMessage"))
+	assert.NoError(t, routing.SetupQueueEvents([]string{"Gauge,Timer", "ContainerMetric,HttpStartStop", "Gauge,ContainerMetric,ValueMetric", "ValueMetric"}))
+
+	containerMetric := &fevents.EnvelopeV2{SourceId: "app", InstanceId: "0", Gauge: &fevents.GaugeV2{Metrics: map[string]fevents.GaugeValueV2{
+		"cpu": {Value: 1}, "memory": {Value: 2}, "disk": {Value: 3}, "memory_quota": {Value: 4}, "disk_quota": {Value: 5},
+	}}}
+	routing.RouteEnvelopeV2(containerMetric)
+	assert.Equal(t, "Gauge", queues[0].Pop().Type)
+	assert.Equal(t, "ContainerMetric", queues[1].Pop().Type, "the queue selecting ContainerMetric gets it while another one selects Gauge")
+	assert.Equal(t, 1, queues[2].GetCount(), "a queue selecting both only gets the Gauge")
+	assert.Equal(t, "Gauge", queues[2].Pop().Type)
+	assert.Equal(t, 0, queues[3].GetCount())
+
+	routing.RouteEnvelopeV2(&fevents.EnvelopeV2{SourceId: "gorouter", Gauge: &fevents.GaugeV2{Metrics: map[string]fevents.GaugeValueV2{"latency": {Unit: "ms", Value: 1.5}}}})
+	assert.Equal(t, "Gauge", queues[0].Pop().Type)
+	assert.Equal(t, 0, queues[1].GetCount())
+	assert.Equal(t, "Gauge", queues[2].Pop().Type)
+	assert.Equal(t, 0, queues[2].GetCount())
+	assert.Equal(t, "ValueMetric", queues[3].Pop().Type)
+
+	routing.RouteEnvelopeV2(&fevents.EnvelopeV2{SourceId: "gorouter", Timer: &fevents.TimerV2{Name: "http", Start: 1, Stop: 2000001}})
+	assert.Equal(t, "Timer", queues[0].Pop().Type)
+	assert.Equal(t, "HttpStartStop", queues[1].Pop().Type)
+	assert.Equal(t, 0, queues[2].GetCount())
+	assert.Equal(t, 0, queues[3].GetCount())
+
+	assert.Equal(t, map[string]uint64{"Gauge": 2, "ContainerMetric": 1, "ValueMetric": 1, "Timer": 1, "HttpStartStop": 1}, routing.GetSelectedEventsCount())
+}
+
+func TestRouteEnvelopeV2SkipsRepresentationsNoQueueTakes(t *testing.T) {
+	queues := newRoutingQueues(1)
+	routing := NewEventRouting(caching.NewCachingEmpty(), queues)
+	assert.NoError(t, routing.SetupEventRouting("Gauge,ValueMetric"))
+
+	routing.RouteEnvelopeV2(&fevents.EnvelopeV2{SourceId: "gorouter", Gauge: &fevents.GaugeV2{Metrics: map[string]fevents.GaugeValueV2{"latency": {Unit: "ms", Value: 1.5}}}})
+	assert.Equal(t, 1, queues[0].GetCount())
+	assert.Equal(t, "Gauge", queues[0].Pop().Type)
+	assert.Equal(t, map[string]uint64{"Gauge": 1}, routing.GetSelectedEventsCount())
+}
@@ -0,0 +1,68 @@
+package eventRouting
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	fevents "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+)
+
+// httpPairing holds HttpStart and HttpStop halves until the other half of the
+// same request is seen, or until the pairing window expires.
+type httpPairing struct {
+	window  time.Duration
+	mutex   *sync.Mutex
+	pending map[string]*pendingHttpEvent
+}
+
+type pendingHttpEvent struct {
+	event *fevents.Event
+	seen  time.Time
+}
+
+func newHttpPairing(window time.Duration) *httpPairing {
+	return &httpPairing{
+		window:  window,
+		mutex:   &sync.Mutex{},
+		pending: make(map[string]*pendingHttpEvent),
+	}
+}
+
+// pair returns the synthetic HttpStartStop event when the other half of the
+// request was already held, otherwise it holds the event. A held half that is
+// replaced by a duplicate of the same type is returned as unpaired.
+func (p *httpPairing) pair(event *fevents.Event, now time.Time) (paired *fevents.Event, unpaired *fevents.Event) {
+	key := fmt.Sprintf("%v/%v", event.Fields["request_id"], event.Fields["peer_type"])
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	other, found := p.pending[key]
+	if !found {
+		p.pending[key] = &pendingHttpEvent{event: event, seen: now}
+		return nil, nil
+	}
+	if other.event.Type == event.Type {
+		p.pending[key] = &pendingHttpEvent{event: event, seen: now}
+		return nil, other.event
+	}
+	delete(p.pending, key)
+	if event.Type == "HttpStop" {
+		return fevents.PairHttpStartStop(other.event, event), nil
+	}
+	return fevents.PairHttpStartStop(event, other.event), nil
+}
+
+// expired removes and returns the halves held for longer than the window.
+func (p *httpPairing) expired(now time.Time) []*fevents.Event {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	expiredEvents := []*fevents.Event{}
+	for key, pending := range p.pending {
+		if now.Sub(pending.seen) >= p.window {
+			expiredEvents = append(expiredEvents, pending.event)
+			delete(p.pending, key)
+		}
+	}
+	return expiredEvents
+}
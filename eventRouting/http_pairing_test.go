@@ -0,0 +1,83 @@
+package eventRouting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+)
+
+func newHttpHalf(eventType string, timestamp int64) *Event {
+	fields := map[string]interface{}{
+		"request_id": "1f2e3d4c-0000-0000-0000-000000000001",
+		"peer_type":  "Client",
+		"timestamp":  timestamp,
+		"cf_app_id":  "7833dc75-4484-409c-9b74-90b6454906c6",
+	}
+	if eventType == "HttpStart" {
+		fields["method"] = "GET"
+		fields["uri"] = "https://app.example.com/health"
+	} else {
+		fields["status_code"] = int32(200)
+		fields["content_length"] = int64(12)
+	}
+	return &Event{Fields: fields, Type: eventType}
+}
+
+func TestHttpPairingStartThenStop(t *testing.T) {
+	pairing := newHttpPairing(time.Second)
+	now := time.Now()
+
+	paired, unpaired := pairing.pair(newHttpHalf("HttpStart", 1483629662000000000), now)
+	assert.Nil(t, paired)
+	assert.Nil(t, unpaired)
+
+	paired, unpaired = pairing.pair(newHttpHalf("HttpStop", 1483629662250000000), now)
+	assert.Nil(t, unpaired)
+	assert.Equal(t, "HttpStartStop", paired.Type)
+	assert.Equal(t, int64(250), paired.Fields["duration_ms"])
+	assert.Equal(t, "GET", paired.Fields["method"])
+	assert.Equal(t, int32(200), paired.Fields["status_code"])
+	assert.Equal(t, int64(1483629662000000000), paired.Fields["start_timestamp"])
+	assert.Equal(t, int64(1483629662250000000), paired.Fields["stop_timestamp"])
+	assert.Empty(t, pairing.expired(now.Add(time.Hour)))
+}
+
+func TestHttpPairingStopThenStart(t *testing.T) {
+	pairing := newHttpPairing(time.Second)
+	now := time.Now()
+
+	pairing.pair(newHttpHalf("HttpStop", 1483629662100000000), now)
+	paired, _ := pairing.pair(newHttpHalf("HttpStart", 1483629662000000000), now)
+
+	assert.Equal(t, int64(100), paired.Fields["duration_ms"])
+}
+
+func TestHttpPairingExpiredHalf(t *testing.T) {
+	pairing := newHttpPairing(time.Second)
+	now := time.Now()
+
+	pairing.pair(newHttpHalf("HttpStart", 1483629662000000000), now)
+	assert.Empty(t, pairing.expired(now.Add(500*time.Millisecond)))
+
+	expired := pairing.expired(now.Add(2 * time.Second))
+	assert.Len(t, expired, 1)
+	assert.Equal(t, "HttpStart", expired[0].Type)
+
+	paired, _ := pairing.pair(newHttpHalf("HttpStop", 1483629662250000000), now.Add(2*time.Second))
+	assert.Nil(t, paired)
+}
+
+func TestHttpPairingDuplicateHalf(t *testing.T) {
+	pairing := newHttpPairing(time.Second)
+	now := time.Now()
+
+	first := newHttpHalf("HttpStart", 1483629662000000000)
+	pairing.pair(first, now)
+	paired, unpaired := pairing.pair(newHttpHalf("HttpStart", 1483629662010000000), now)
+
+	assert.Nil(t, paired)
+	assert.Equal(t, first, unpaired)
+}
@@ -2,6 +2,7 @@ package events
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/caching"
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/utils"
@@ -12,11 +13,50 @@ type Event struct {
 	Fields map[string]interface{}
 	Msg    string
 	Type   string
+	// Tags holds the envelope tags copied into Fields, keyed by field name.
+	Tags map[string]string `json:"-"`
+}
+
+// TagsConfig selects which envelope tags are copied into the event fields.
+// An empty Include list copies every tag not listed in Exclude.
+type TagsConfig struct {
+	Prefix  string
+	Include map[string]bool
+	Exclude map[string]bool
+}
+
+// NewTagsConfig builds a TagsConfig from comma separated lists of tag names.
+func NewTagsConfig(prefix string, include string, exclude string) *TagsConfig {
+	return &TagsConfig{
+		Prefix:  prefix,
+		Include: tagNamesSet(include),
+		Exclude: tagNamesSet(exclude),
+	}
+}
+
+func tagNamesSet(tagNames string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range strings.Split(tagNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			set[name] = true
+		}
+	}
+	return set
 }
 
 // Fields type
 type Fields map[string]interface{}
 
+// IsMetric reports whether events of this type are sent as carbon2 metrics
+// rather than JSON logs.
+func IsMetric(eventType string) bool {
+	switch eventType {
+	case "ValueMetric", "CounterEvent", "ContainerMetric", "Gauge", "Timer":
+		return true
+	}
+	return false
+}
+
 func HttpStartStop(msg *events.Envelope) *Event {
 	httpStartStop := msg.GetHttpStartStop()
 
@@ -45,6 +85,87 @@ func HttpStartStop(msg *events.Envelope) *Event {
 	}
 }
 
+func HttpStart(msg *events.Envelope) *Event {
+	httpStart := msg.GetHttpStart()
+
+	fields := Fields{
+		"cf_app_id":         utils.FormatUUID(httpStart.GetApplicationId()),
+		"instance_id":       httpStart.GetInstanceId(),
+		"instance_index":    httpStart.GetInstanceIndex(),
+		"method":            httpStart.GetMethod().String(),
+		"parent_request_id": utils.FormatUUID(httpStart.GetParentRequestId()),
+		"peer_type":         httpStart.GetPeerType().String(),
+		"remote_addr":       httpStart.GetRemoteAddress(),
+		"request_id":        utils.FormatUUID(httpStart.GetRequestId()),
+		"timestamp":         httpStart.GetTimestamp(),
+		"uri":               httpStart.GetUri(),
+		"user_agent":        httpStart.GetUserAgent(),
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    "",
+	}
+}
+
+func HttpStop(msg *events.Envelope) *Event {
+	httpStop := msg.GetHttpStop()
+
+	fields := Fields{
+		"cf_app_id":      utils.FormatUUID(httpStop.GetApplicationId()),
+		"content_length": httpStop.GetContentLength(),
+		"peer_type":      httpStop.GetPeerType().String(),
+		"request_id":     utils.FormatUUID(httpStop.GetRequestId()),
+		"status_code":    httpStop.GetStatusCode(),
+		"timestamp":      httpStop.GetTimestamp(),
+		"uri":            httpStop.GetUri(),
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    "",
+	}
+}
+
+// PairHttpStartStop merges the two halves of a request into a synthetic
+// HttpStartStop event, computing its duration from their timestamps.
+func PairHttpStartStop(start *Event, stop *Event) *Event {
+	fields := Fields{}
+	for k, v := range start.Fields {
+		fields[k] = v
+	}
+	for k, v := range stop.Fields {
+		if _, exists := fields[k]; !exists || k == "status_code" || k == "content_length" {
+			fields[k] = v
+		}
+	}
+	delete(fields, "timestamp")
+
+	startTimestamp, _ := start.Fields["timestamp"].(int64)
+	stopTimestamp, _ := stop.Fields["timestamp"].(int64)
+	fields["start_timestamp"] = startTimestamp
+	fields["stop_timestamp"] = stopTimestamp
+	fields["duration_ms"] = ((stopTimestamp - startTimestamp) / 1000) / 1000
+
+	var tags map[string]string
+	if len(start.Tags)+len(stop.Tags) > 0 {
+		tags = make(map[string]string)
+		for k, v := range stop.Tags {
+			tags[k] = v
+		}
+		for k, v := range start.Tags {
+			tags[k] = v
+		}
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    "",
+		Type:   "HttpStartStop",
+		Tags:   tags,
+	}
+}
+
 func LogMessage(msg *events.Envelope) *Event {
 	logMessage := msg.GetLogMessage()
 
@@ -197,6 +318,25 @@ func (e *Event) AnnotateWithEnveloppeData(msg *events.Envelope) {
 	e.Type = msg.GetEventType().String()
 }
 
+// AnnotateWithTags copies the envelope tags allowed by the config into the
+// fields, without overriding the fields already set from the envelope.
+func (e *Event) AnnotateWithTags(tags map[string]string, config *TagsConfig) {
+	for name, value := range tags {
+		if config.Exclude[name] || (len(config.Include) > 0 && !config.Include[name]) {
+			continue
+		}
+		key := config.Prefix + name
+		if _, exists := e.Fields[key]; exists {
+			continue
+		}
+		if e.Tags == nil {
+			e.Tags = make(map[string]string)
+		}
+		e.Fields[key] = value
+		e.Tags[key] = value
+	}
+}
+
 func (e *Event) CopyEvent() *Event {
 	fields := make(map[string]interface{})
 
@@ -208,5 +348,6 @@ func (e *Event) CopyEvent() *Event {
 		Fields: fields,
 		Msg:    e.Msg,
 		Type:   e.Type,
+		Tags:   e.Tags,
 	}
 }
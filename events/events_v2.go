@@ -0,0 +1,312 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+)
+
+var guidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// EnvelopeV2 is the JSON representation of a loggregator v2 envelope as
+// served by the Reverse Log Proxy (RLP) gateway.
+type EnvelopeV2 struct {
+	Timestamp      Int64String       `json:"timestamp"`
+	SourceId       string            `json:"sourceId"`
+	InstanceId     string            `json:"instanceId"`
+	DeprecatedTags map[string]string `json:"deprecatedTags"`
+	Tags           map[string]string `json:"tags"`
+	Log            *LogV2            `json:"log"`
+	Counter        *CounterV2        `json:"counter"`
+	Gauge          *GaugeV2          `json:"gauge"`
+	Timer          *TimerV2          `json:"timer"`
+	Event          *EventV2          `json:"event"`
+}
+
+type LogV2 struct {
+	Payload []byte `json:"payload"`
+	Type    string `json:"type"`
+}
+
+type CounterV2 struct {
+	Name  string       `json:"name"`
+	Delta Uint64String `json:"delta"`
+	Total Uint64String `json:"total"`
+}
+
+type GaugeV2 struct {
+	Metrics map[string]GaugeValueV2 `json:"metrics"`
+}
+
+type GaugeValueV2 struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+type TimerV2 struct {
+	Name  string      `json:"name"`
+	Start Int64String `json:"start"`
+	Stop  Int64String `json:"stop"`
+}
+
+type EventV2 struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// EnvelopeBatchV2 is the payload of a single RLP gateway server-sent event.
+type EnvelopeBatchV2 struct {
+	Batch []*EnvelopeV2 `json:"batch"`
+}
+
+// Int64String decodes 64-bit integers that the gateway encodes as JSON strings.
+type Int64String int64
+
+func (i *Int64String) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(string(bytes.Trim(data, "\"")), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = Int64String(value)
+	return nil
+}
+
+// Uint64String decodes unsigned 64-bit integers that the gateway encodes as JSON strings.
+type Uint64String uint64
+
+func (u *Uint64String) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseUint(string(bytes.Trim(data, "\"")), 10, 64)
+	if err != nil {
+		return err
+	}
+	*u = Uint64String(value)
+	return nil
+}
+
+// ParseEnvelopeBatchV2 decodes the data of an RLP gateway server-sent event.
+func ParseEnvelopeBatchV2(data []byte) ([]*EnvelopeV2, error) {
+	batch := EnvelopeBatchV2{}
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, err
+	}
+	return batch.Batch, nil
+}
+
+// tag looks up a v2 tag, falling back to the deprecated tags sent by older emitters.
+func (env *EnvelopeV2) tag(name string) string {
+	if value, ok := env.Tags[name]; ok {
+		return value
+	}
+	return env.DeprecatedTags[name]
+}
+
+// AllTags merges the deprecated tags and the tags of the envelope.
+func (env *EnvelopeV2) AllTags() map[string]string {
+	tags := make(map[string]string, len(env.DeprecatedTags)+len(env.Tags))
+	for k, v := range env.DeprecatedTags {
+		tags[k] = v
+	}
+	for k, v := range env.Tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// Origin returns the v1 origin of the envelope, falling back to its source id.
+func (env *EnvelopeV2) Origin() string {
+	if origin := env.tag("origin"); origin != "" {
+		return origin
+	}
+	return env.SourceId
+}
+
+// IsContainerMetric reports whether a gauge carries the container metrics
+// emitted by Diego for application instances.
+func (env *EnvelopeV2) IsContainerMetric() bool {
+	if env.Gauge == nil {
+		return false
+	}
+	for _, name := range []string{"cpu", "memory", "disk", "memory_quota", "disk_quota"} {
+		if _, ok := env.Gauge.Metrics[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func LogMessageV2(env *EnvelopeV2) *Event {
+	messageType := env.Log.Type
+	if messageType == "" {
+		messageType = "OUT"
+	}
+
+	fields := Fields{
+		"cf_app_id":       env.SourceId,
+		"timestamp":       int64(env.Timestamp),
+		"source_type":     env.tag("source_type"),
+		"message_type":    messageType,
+		"source_instance": env.InstanceId,
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    string(env.Log.Payload),
+	}
+}
+
+func CounterEventV2(env *EnvelopeV2) *Event {
+	fields := Fields{
+		"name":      env.Counter.Name,
+		"timestamp": int64(env.Timestamp),
+		"delta":     uint64(env.Counter.Delta),
+		"total":     uint64(env.Counter.Total),
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    "",
+	}
+}
+
+// ValueMetricsV2 returns one ValueMetric event per value carried by the gauge.
+func ValueMetricsV2(env *EnvelopeV2) []*Event {
+	valueMetrics := []*Event{}
+	for name, metric := range env.Gauge.Metrics {
+		fields := Fields{
+			"name":      name,
+			"timestamp": int64(env.Timestamp),
+			"unit":      metric.Unit,
+			"value":     metric.Value,
+		}
+		valueMetrics = append(valueMetrics, &Event{
+			Fields: fields,
+			Msg:    "",
+		})
+	}
+	return valueMetrics
+}
+
+func ContainerMetricV2(env *EnvelopeV2) *Event {
+	metrics := env.Gauge.Metrics
+	instanceIndex, _ := strconv.Atoi(env.InstanceId)
+
+	fields := Fields{
+		"cf_app_id":          env.SourceId,
+		"timestamp":          int64(env.Timestamp),
+		"cpu_percentage":     metrics["cpu"].Value,
+		"disk_bytes":         uint64(metrics["disk"].Value),
+		"disk_bytes_quota":   uint64(metrics["disk_quota"].Value),
+		"instance_index":     int32(instanceIndex),
+		"memory_bytes":       uint64(metrics["memory"].Value),
+		"memory_bytes_quota": uint64(metrics["memory_quota"].Value),
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    "",
+	}
+}
+
+func HttpStartStopV2(env *EnvelopeV2) *Event {
+	start := int64(env.Timer.Start)
+	stop := int64(env.Timer.Stop)
+
+	fields := Fields{
+		"cf_app_id":       env.SourceId,
+		"content_length":  env.tag("content_length"),
+		"instance_id":     env.tag("instance_id"),
+		"instance_index":  env.InstanceId,
+		"method":          env.tag("method"),
+		"peer_type":       env.tag("peer_type"),
+		"remote_addr":     env.tag("remote_address"),
+		"request_id":      env.tag("request_id"),
+		"start_timestamp": start,
+		"status_code":     env.tag("status_code"),
+		"stop_timestamp":  stop,
+		"uri":             env.tag("uri"),
+		"user_agent":      env.tag("user_agent"),
+		"duration_ms":     ((stop - start) / 1000) / 1000,
+		"forwarded":       env.tag("forwarded"),
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    "",
+	}
+}
+
+// Timer keeps a v2 timer (e.g. gorouter HTTP request timing) as a first-class event.
+func Timer(env *EnvelopeV2) *Event {
+	start := int64(env.Timer.Start)
+	stop := int64(env.Timer.Stop)
+
+	fields := Fields{
+		"name":            env.Timer.Name,
+		"source_id":       env.SourceId,
+		"instance_id":     env.InstanceId,
+		"timestamp":       int64(env.Timestamp),
+		"start_timestamp": start,
+		"stop_timestamp":  stop,
+		"duration_ms":     ((stop - start) / 1000) / 1000,
+		"peer_type":       env.tag("peer_type"),
+	}
+	if guidPattern.MatchString(env.SourceId) {
+		fields["cf_app_id"] = env.SourceId
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    "",
+	}
+}
+
+// Gauge keeps all the values of a v2 gauge in a single event, under the
+// "metrics" field keyed by value name.
+func Gauge(env *EnvelopeV2) *Event {
+	metrics := make(map[string]GaugeValueV2, len(env.Gauge.Metrics))
+	for name, metric := range env.Gauge.Metrics {
+		metrics[name] = metric
+	}
+
+	fields := Fields{
+		"source_id":   env.SourceId,
+		"instance_id": env.InstanceId,
+		"timestamp":   int64(env.Timestamp),
+		"metrics":     metrics,
+	}
+	if guidPattern.MatchString(env.SourceId) {
+		fields["cf_app_id"] = env.SourceId
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    "",
+	}
+}
+
+// PlatformEventV2 maps a v2 event envelope (e.g. an app crash) onto a log message.
+func PlatformEventV2(env *EnvelopeV2) *Event {
+	fields := Fields{
+		"cf_app_id":       env.SourceId,
+		"timestamp":       int64(env.Timestamp),
+		"source_type":     "EVENT",
+		"message_type":    "OUT",
+		"source_instance": env.InstanceId,
+		"title":           env.Event.Title,
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    env.Event.Body,
+	}
+}
+
+func (e *Event) AnnotateWithEnvelopeV2Data(env *EnvelopeV2, eventType string) {
+	e.Fields["origin"] = env.Origin()
+	e.Fields["deployment"] = env.tag("deployment")
+	e.Fields["ip"] = env.tag("ip")
+	e.Fields["job"] = env.tag("job")
+	e.Fields["job_index"] = env.tag("index")
+	e.Type = eventType
+}
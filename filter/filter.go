@@ -0,0 +1,190 @@
+// Package filter evaluates filter expressions against the fields of events,
+// before they are serialized. For example:
+//
+//	cf_org_name == "prod" && !(source_type =~ "^RTR") && instance_index < 3
+//
+// A field is compared with a string, number or boolean literal using ==, !=,
+// <, <=, >, >=, the regular expression operators =~ and !~, or the prefix
+// operator ^=. A field alone tests that it is set. Expressions are combined
+// with &&, || and !, and grouped with parentheses. The envelope tags of an
+// event are looked up when it has no field of that name.
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+)
+
+// Expression is a parsed filter expression.
+type Expression struct {
+	source string
+	root   node
+}
+
+// Parse parses a filter expression. An empty expression matches every event.
+func Parse(expression string) (*Expression, error) {
+	p := &parser{lexer: &lexer{input: expression}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.token.kind == tokenEnd {
+		return &Expression{source: expression}, nil
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind != tokenEnd {
+		return nil, p.unexpected()
+	}
+	return &Expression{source: expression, root: root}, nil
+}
+
+// Match tells whether an event matches the expression.
+func (e *Expression) Match(event *events.Event) bool {
+	if e == nil || e.root == nil {
+		return true
+	}
+	return e.root.eval(event)
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+type node interface {
+	eval(event *events.Event) bool
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(event *events.Event) bool {
+	return n.left.eval(event) && n.right.eval(event)
+}
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(event *events.Event) bool {
+	return n.left.eval(event) || n.right.eval(event)
+}
+
+type notNode struct{ operand node }
+
+func (n notNode) eval(event *events.Event) bool {
+	return !n.operand.eval(event)
+}
+
+// presenceNode is a field alone, set when it is present and neither empty nor
+// false.
+type presenceNode struct{ field string }
+
+func (n presenceNode) eval(event *events.Event) bool {
+	value, found := lookup(event, n.field)
+	if !found || value == nil {
+		return false
+	}
+	switch v := value.(type) {
+	case string:
+		return v != ""
+	case bool:
+		return v
+	}
+	return true
+}
+
+// comparisonNode compares a field with a literal. A missing field only
+// matches != and !~.
+type comparisonNode struct {
+	field    string
+	operator string
+	text     string
+	number   float64
+	isNumber bool
+	pattern  *regexp.Regexp
+}
+
+func (n comparisonNode) eval(event *events.Event) bool {
+	value, found := lookup(event, n.field)
+	if !found || value == nil {
+		return n.operator == "!=" || n.operator == "!~"
+	}
+	switch n.operator {
+	case "=~":
+		return n.pattern.MatchString(text(value))
+	case "!~":
+		return !n.pattern.MatchString(text(value))
+	case "^=":
+		return strings.HasPrefix(text(value), n.text)
+	case "==":
+		return n.equal(value)
+	case "!=":
+		return !n.equal(value)
+	}
+	number, ok := toNumber(value)
+	if !ok {
+		return false
+	}
+	switch n.operator {
+	case "<":
+		return number < n.number
+	case "<=":
+		return number <= n.number
+	case ">":
+		return number > n.number
+	case ">=":
+		return number >= n.number
+	}
+	return false
+}
+
+func (n comparisonNode) equal(value interface{}) bool {
+	if n.isNumber {
+		number, ok := toNumber(value)
+		return ok && number == n.number
+	}
+	return text(value) == n.text
+}
+
+func lookup(event *events.Event, field string) (interface{}, bool) {
+	if value, found := event.Fields[field]; found {
+		return value, true
+	}
+	if value, found := event.Tags[field]; found {
+		return value, true
+	}
+	return nil, false
+}
+
+func text(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprint(value)
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,80 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func routerLog() *events.Event {
+	return &events.Event{
+		Fields: map[string]interface{}{
+			"cf_org_name":    "prod",
+			"cf_app_name":    "web",
+			"source_type":    "RTR",
+			"job":            "router",
+			"instance_index": int32(2),
+			"timestamp":      int64(1483629662001580713),
+			"truncated":      false,
+		},
+		Msg:  "job:diego in the message",
+		Tags: map[string]string{"zone": "z1"},
+		Type: "LogMessage",
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		expression string
+		match      bool
+	}{
+		{``, true},
+		{`cf_org_name == "prod"`, true},
+		{`cf_org_name != "prod"`, false},
+		{`cf_org_name == "prod" && !(source_type =~ "^RTR")`, false},
+		{`cf_org_name == "dev" || job == "router"`, true},
+		{`!(cf_org_name == "dev") && job ^= "rou"`, true},
+		{`job == "diego"`, false},
+		{`instance_index == 2`, true},
+		{`instance_index >= 3`, false},
+		{`instance_index < 3 && timestamp > 0`, true},
+		{`cf_app_name !~ "^w"`, false},
+		{`missing == "x"`, false},
+		{`missing != "x"`, true},
+		{`missing < 3`, false},
+		{`missing`, false},
+		{`cf_app_name && !truncated`, true},
+		{`truncated == false`, true},
+		{`zone == "z1"`, true},
+		{`a == "1" || b == "2" && c == "3"`, false},
+		{`(cf_org_name == "prod" || a) && zone == "z1"`, true},
+		{`source_type == "R\"TR" || job == "router"`, true},
+	}
+	for _, c := range cases {
+		parsed, err := Parse(c.expression)
+		if assert.NoError(t, err, c.expression) {
+			assert.Equal(t, c.match, parsed.Match(routerLog()), c.expression)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expression := range []string{
+		`cf_org_name ==`,
+		`cf_org_name == prod`,
+		`== "prod"`,
+		`(job == "router"`,
+		`job == "router")`,
+		`job == "router" &&`,
+		`job =~ "("`,
+		`job =~ 3`,
+		`instance_index < "3"`,
+		`job == "unterminated`,
+		`job = "router"`,
+		`job == 1-2`,
+	} {
+		_, err := Parse(expression)
+		assert.Error(t, err, expression)
+	}
+}
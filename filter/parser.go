@@ -0,0 +1,249 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdentifier
+	tokenString
+	tokenNumber
+	tokenComparison
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind     tokenKind
+	text     string
+	position int
+}
+
+// comparisons are sorted so that two characters operators are tried first.
+var comparisons = []string{"==", "!=", "=~", "!~", "^=", "<=", ">=", "<", ">"}
+
+type lexer struct {
+	input    string
+	position int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.position < len(l.input) && unicode.IsSpace(rune(l.input[l.position])) {
+		l.position++
+	}
+	start := l.position
+	if start == len(l.input) {
+		return token{kind: tokenEnd, position: start}, nil
+	}
+	rest := l.input[start:]
+	for _, operator := range comparisons {
+		if strings.HasPrefix(rest, operator) {
+			l.position += len(operator)
+			return token{kind: tokenComparison, text: operator, position: start}, nil
+		}
+	}
+	switch {
+	case strings.HasPrefix(rest, "&&"):
+		l.position += 2
+		return token{kind: tokenAnd, text: "&&", position: start}, nil
+	case strings.HasPrefix(rest, "||"):
+		l.position += 2
+		return token{kind: tokenOr, text: "||", position: start}, nil
+	case rest[0] == '!':
+		l.position++
+		return token{kind: tokenNot, text: "!", position: start}, nil
+	case rest[0] == '(':
+		l.position++
+		return token{kind: tokenOpen, text: "(", position: start}, nil
+	case rest[0] == ')':
+		l.position++
+		return token{kind: tokenClose, text: ")", position: start}, nil
+	case rest[0] == '"':
+		return l.quoted(start)
+	case rest[0] == '-' || rest[0] == '.' || isDigit(rest[0]):
+		for l.position++; l.position < len(l.input) && (isDigit(l.input[l.position]) || strings.ContainsRune(".eE+-", rune(l.input[l.position]))); l.position++ {
+		}
+		return token{kind: tokenNumber, text: l.input[start:l.position], position: start}, nil
+	case isIdentifier(rest[0]):
+		for l.position++; l.position < len(l.input) && (isIdentifier(l.input[l.position]) || isDigit(l.input[l.position]) || l.input[l.position] == '.'); l.position++ {
+		}
+		return token{kind: tokenIdentifier, text: l.input[start:l.position], position: start}, nil
+	}
+	return token{}, fmt.Errorf("unexpected character %q at position %d", rest[0], start)
+}
+
+func (l *lexer) quoted(start int) (token, error) {
+	for l.position++; l.position < len(l.input); l.position++ {
+		switch l.input[l.position] {
+		case '\\':
+			l.position++
+		case '"':
+			l.position++
+			value, err := strconv.Unquote(l.input[start:l.position])
+			if err != nil {
+				return token{}, fmt.Errorf("invalid string at position %d: %v", start, err)
+			}
+			return token{kind: tokenString, text: value, position: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unterminated string at position %d", start)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifier(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// parser is a recursive descent parser, from the lowest precedence (||) to the
+// highest (!).
+type parser struct {
+	lexer *lexer
+	token token
+}
+
+func (p *parser) advance() error {
+	t, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.token = t
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	if p.token.kind == tokenEnd {
+		return fmt.Errorf("unexpected end of filter %q", p.lexer.input)
+	}
+	return fmt.Errorf("unexpected %q at position %d", p.token.text, p.token.position)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenOr {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenAnd {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	switch p.token.kind {
+	case tokenNot:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	case tokenOpen:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.token.kind != tokenClose {
+			return nil, p.unexpected()
+		}
+		return inner, p.advance()
+	case tokenIdentifier:
+		return p.parseComparison()
+	}
+	return nil, p.unexpected()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	field := p.token.text
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.token.kind != tokenComparison {
+		return presenceNode{field}, nil
+	}
+	operator := p.token
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	literal := p.token
+	comparison := comparisonNode{field: field, operator: operator.text, text: literal.text}
+	switch literal.kind {
+	case tokenString:
+	case tokenNumber:
+		number, err := strconv.ParseFloat(literal.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", literal.text, literal.position)
+		}
+		comparison.number = number
+		comparison.isNumber = true
+	case tokenIdentifier:
+		if literal.text != "true" && literal.text != "false" {
+			return nil, fmt.Errorf("expected a string, number or boolean after %s at position %d, got %q", operator.text, literal.position, literal.text)
+		}
+	default:
+		return nil, p.unexpected()
+	}
+
+	switch operator.text {
+	case "=~", "!~":
+		if literal.kind != tokenString {
+			return nil, fmt.Errorf("expected a regular expression string after %s at position %d", operator.text, literal.position)
+		}
+		pattern, err := regexp.Compile(literal.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at position %d: %v", literal.position, err)
+		}
+		comparison.pattern = pattern
+	case "^=":
+		if literal.kind != tokenString {
+			return nil, fmt.Errorf("expected a string after ^= at position %d", literal.position)
+		}
+	case "<", "<=", ">", ">=":
+		if !comparison.isNumber {
+			return nil, fmt.Errorf("expected a number after %s at position %d", operator.text, literal.position)
+		}
+	}
+	return comparison, p.advance()
+}
@@ -1,17 +1,28 @@
 package firehoseclient
 
 import (
+	"context"
 	"crypto/tls"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/cloudfoundry/noaa/consumer"
 	"github.com/cloudfoundry/sonde-go/events"
-	"github.com/gorilla/websocket"
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventRouting"
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/utils"
 )
 
+// Nozzle reads the envelopes of the platform and routes them, reconnecting
+// until it gives up or until it is stopped.
+type Nozzle interface {
+	Start() error
+	Stop()
+	Reconnects() uint64
+	Connected() bool
+}
+
 type FirehoseNozzle struct {
 	errs         <-chan error
 	messages     <-chan *events.Envelope
@@ -19,6 +30,11 @@ type FirehoseNozzle struct {
 	eventRouting *eventRouting.EventRouting
 	config       *FirehoseConfig
 	cfClient     *cfclient.Client
+	backoff      *utils.Backoff
+	reconnects   uint64
+	connected    int32
+	stopped      context.Context
+	stop         context.CancelFunc
 }
 
 type FirehoseConfig struct {
@@ -26,6 +42,7 @@ type FirehoseConfig struct {
 	InsecureSSLSkipVerify  bool
 	IdleTimeoutSeconds     time.Duration
 	FirehoseSubscriptionID string
+	ReconnectConfig
 }
 
 type CfClientTokenRefresh struct {
@@ -33,22 +50,52 @@ type CfClientTokenRefresh struct {
 }
 
 func NewFirehoseNozzle(cfClient *cfclient.Client, eventRouting *eventRouting.EventRouting, firehoseconfig *FirehoseConfig) *FirehoseNozzle {
+	stopped, stop := context.WithCancel(context.Background())
 	return &FirehoseNozzle{
 		errs:         make(<-chan error),
 		messages:     make(<-chan *events.Envelope),
 		eventRouting: eventRouting,
 		config:       firehoseconfig,
 		cfClient:     cfClient,
+		backoff:      utils.NewBackoff(firehoseconfig.MinRetryDelay, firehoseconfig.MaxRetryDelay),
+		stopped:      stopped,
+		stop:         stop,
 	}
 }
 
+// Start reads the firehose until it gives up reconnecting, returning the last
+// error, or until it is stopped, returning nil.
 func (f *FirehoseNozzle) Start() error {
 	logging.Info.Printf("Started the Nozzle... \n")
-	f.consumeFirehose()
-	logging.Info.Printf("consume the firehose... \n")
-	err := f.routeEvent()
-	return err
+	for {
+		f.consumeFirehose()
+		logging.Info.Printf("consume the firehose... \n")
+		err := f.routeEvent()
+		if f.stopped.Err() != nil {
+			f.consumer.Close()
+			atomic.StoreInt32(&f.connected, 0)
+			logging.Info.Printf("Stopped reading the firehose \n")
+			return nil
+		}
+		if !f.handleError(err) {
+			return err
+		}
+	}
+}
 
+// Stop makes Start return once the envelope being routed is handled.
+func (f *FirehoseNozzle) Stop() {
+	f.stop()
+}
+
+// Reconnects returns the number of reconnects to the firehose since start.
+func (f *FirehoseNozzle) Reconnects() uint64 {
+	return atomic.LoadUint64(&f.reconnects)
+}
+
+// Connected reports whether envelopes are received from the firehose.
+func (f *FirehoseNozzle) Connected() bool {
+	return atomic.LoadInt32(&f.connected) == 1
 }
 
 func (f *FirehoseNozzle) consumeFirehose() {
@@ -59,49 +106,106 @@ func (f *FirehoseNozzle) consumeFirehose() {
 	refresher := CfClientTokenRefresh{cfClient: f.cfClient}
 	f.consumer.RefreshTokenFrom(&refresher)
 	f.consumer.SetIdleTimeout(time.Duration(f.config.IdleTimeoutSeconds) * time.Second)
-	f.messages, f.errs = f.consumer.Firehose(f.config.FirehoseSubscriptionID, "")
+	if filter, filtered := firehoseFilter(f.eventRouting.GetSelectedEvents(), f.eventRouting.ReportsDroppedMessages()); filtered {
+		logging.Info.Printf("Subscribing to the filtered firehose (%s)... \n", filterNames[filter])
+		f.messages, f.errs = f.consumer.FilteredFirehose(f.config.FirehoseSubscriptionID, "", filter)
+	} else {
+		f.messages, f.errs = f.consumer.Firehose(f.config.FirehoseSubscriptionID, "")
+	}
+}
+
+var filterNames = map[consumer.EnvelopeFilter]string{
+	consumer.LogMessages: "logs",
+	consumer.Metrics:     "metrics",
+}
+
+// metricsFilterEvents are the event types sent by the traffic controller on
+// the metrics filtered firehose.
+var metricsFilterEvents = map[string]bool{
+	"ValueMetric":     true,
+	"CounterEvent":    true,
+	"ContainerMetric": true,
+	"HttpStartStop":   true,
+}
+
+// firehoseFilter returns the server-side filter matching the selected events:
+// logs when LogMessage is the only selected event, metrics when only metric
+// events are selected. Any other selection needs the full firehose. The logs
+// filter leaves out the doppler counter of dropped messages, so it is not used
+// when they are reported.
+func firehoseFilter(selectedEvents map[string]bool, droppedMessages bool) (consumer.EnvelopeFilter, bool) {
+	logsOnly, metricsOnly := true, true
+	for eventType, selected := range selectedEvents {
+		if !selected {
+			continue
+		}
+		logsOnly = logsOnly && eventType == "LogMessage"
+		metricsOnly = metricsOnly && metricsFilterEvents[eventType]
+	}
+	switch {
+	case logsOnly && selectedEvents["LogMessage"] && !droppedMessages:
+		return consumer.LogMessages, true
+	case metricsOnly && len(selectedEvents) > 0:
+		return consumer.Metrics, true
+	}
+	return 0, false
 }
 
 func (f *FirehoseNozzle) routeEvent() error {
+	connected := false
 	for {
 		select {
 		case envelope := <-f.messages:
+			if !connected {
+				f.backoff.Reset()
+				atomic.StoreInt32(&f.connected, 1)
+				connected = true
+			}
+			f.handleMessage(envelope)
 			f.eventRouting.RouteEvent(envelope)
+		case <-f.stopped.Done():
+			return nil
 		case err := <-f.errs:
-			f.handleError(err)
+			if err == nil {
+				continue
+			}
+			atomic.StoreInt32(&f.connected, 0)
 			return err
 		}
 	}
 }
 
-func (f *FirehoseNozzle) handleError(err error) {
+// handleError closes the current connection and waits before reconnecting.
+// It returns false when the nozzle must stop.
+func (f *FirehoseNozzle) handleError(err error) bool {
+	f.consumer.Close()
 
-	switch {
-	case websocket.IsCloseError(err, websocket.CloseNormalClosure):
+	switch classifyDisconnect(err) {
+	case normalClosure:
 		logging.Error.Printf("Normal Websocket Closure: %v ", err)
 		logging.Error.Printf("Closing connection with traffic controller due to error: %v", err)
-		f.consumer.Close()
-	case websocket.IsCloseError(err, websocket.ClosePolicyViolation):
+		return false
+	case authFailure:
+		logging.Error.Printf("Authentication error while reading from the firehose: %v", err)
+		if !waitBeforeReconnect(f.backoff, f.config.ReconnectConfig, &f.reconnects, "firehose", f.stopped) {
+			return false
+		}
+		f.ResetCfClient()
+	case slowConsumer:
 		logging.Error.Printf("Error while reading from the firehose: %v ", err)
 		logging.Error.Println("Disconnected because nozzle couldn't keep up. Please try scaling up the nozzle.")
-		logging.Trace.Println("Waiting for 60 seconds")
-		time.Sleep(60000 * time.Millisecond)
-		logging.Trace.Println("Trying to re-start firehose Client after fault...")
-		f.ResetCfClient()
-		f.Start()
+		return waitBeforeReconnect(f.backoff, f.config.ReconnectConfig, &f.reconnects, "firehose", f.stopped)
 	default:
 		logging.Error.Printf("Error while reading from the firehose: %v", err)
-		logging.Trace.Println("Waiting for 60 seconds")
-		time.Sleep(60000 * time.Millisecond)
-		logging.Trace.Println("Trying to re-start firehose Client after fault...")
-		f.ResetCfClient()
-		f.Start()
+		return waitBeforeReconnect(f.backoff, f.config.ReconnectConfig, &f.reconnects, "firehose", f.stopped)
 	}
+	return true
 }
 
 func (f *FirehoseNozzle) handleMessage(envelope *events.Envelope) {
-	if envelope.GetEventType() == events.Envelope_CounterEvent && envelope.CounterEvent.GetName() == "TruncatingBuffer.DroppedMessages" && envelope.GetOrigin() == "doppler" {
-		logging.Info.Println("We've intercepted an upstream message which indicates that the nozzle or the TrafficController is not keeping up. Please try scaling up the nozzle.")
+	if eventRouting.IsDroppedMessagesCounter(envelope) {
+		logging.Trace.Println("We've intercepted an upstream message which indicates that the nozzle or the TrafficController is not keeping up. Please try scaling up the nozzle.")
+		f.eventRouting.RecordDroppedMessages(envelope)
 	}
 }
 
@@ -110,13 +214,19 @@ func (ct *CfClientTokenRefresh) RefreshAuthToken() (string, error) {
 }
 
 func (f *FirehoseNozzle) ResetCfClient() {
+	f.cfClient = resetCfClient(f.cfClient)
+}
+
+// resetCfClient logs in again with the original configuration, keeping the
+// current client when the new one cannot be created.
+func resetCfClient(cfClient *cfclient.Client) *cfclient.Client {
 	logging.Info.Printf("Resetting cfClient...")
-	client, err := cfclient.NewClient(cleanCfConfig(f.cfClient.Config))
+	client, err := cfclient.NewClient(cleanCfConfig(cfClient.Config))
 	if err != nil {
 		logging.Error.Printf("Failed to reset cfClient: %v", err)
-		return
+		return cfClient
 	}
-	f.cfClient = client
+	return client
 }
 
 func cleanCfConfig(config cfclient.Config) (*cfclient.Config) {
@@ -124,6 +234,8 @@ func cleanCfConfig(config cfclient.Config) (*cfclient.Config) {
 		ApiAddress:        config.ApiAddress,
 		Username:          config.Username,
 		Password:          config.Password,
+		ClientID:          config.ClientID,
+		ClientSecret:      config.ClientSecret,
 		SkipSslValidation: config.SkipSslValidation,
 	}
 	return &c
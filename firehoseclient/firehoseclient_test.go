@@ -0,0 +1,71 @@
+package firehoseclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/utils"
+	"github.com/cloudfoundry/noaa/consumer"
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirehoseFilterLogsOnly(t *testing.T) {
+	filter, filtered := firehoseFilter(map[string]bool{"LogMessage": true}, false)
+
+	assert.True(t, filtered)
+	assert.Equal(t, consumer.LogMessages, filter)
+}
+
+func TestFirehoseFilterLogsOnlyReportingDroppedMessages(t *testing.T) {
+	_, filtered := firehoseFilter(map[string]bool{"LogMessage": true}, true)
+
+	assert.False(t, filtered, "the logs filter leaves out the dropped messages counters")
+}
+
+func TestFirehoseFilterMetricsOnly(t *testing.T) {
+	filter, filtered := firehoseFilter(map[string]bool{"ValueMetric": true, "ContainerMetric": true, "CounterEvent": true}, true)
+
+	assert.True(t, filtered)
+	assert.Equal(t, consumer.Metrics, filter)
+}
+
+func TestFirehoseFilterLogsAndMetrics(t *testing.T) {
+	_, filtered := firehoseFilter(map[string]bool{"LogMessage": true, "ContainerMetric": true}, false)
+
+	assert.False(t, filtered)
+}
+
+func TestFirehoseFilterMetricsAndError(t *testing.T) {
+	_, filtered := firehoseFilter(map[string]bool{"ValueMetric": true, "Error": true}, false)
+
+	assert.False(t, filtered)
+}
+
+func TestWaitBeforeReconnectStops(t *testing.T) {
+	logging.Init(io.Discard, io.Discard, io.Discard, io.Discard)
+	stopped, stop := context.WithCancel(context.Background())
+	var reconnects uint64
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		stop()
+	}()
+
+	start := time.Now()
+	assert.False(t, waitBeforeReconnect(utils.NewBackoff(time.Minute, time.Minute), ReconnectConfig{}, &reconnects, "firehose", stopped))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestClassifyDisconnect(t *testing.T) {
+	assert.Equal(t, normalClosure, classifyDisconnect(&websocket.CloseError{Code: websocket.CloseNormalClosure}))
+	assert.Equal(t, slowConsumer, classifyDisconnect(noaaerrors.NewRetryError(&websocket.CloseError{Code: websocket.ClosePolicyViolation})))
+	assert.Equal(t, authFailure, classifyDisconnect(noaaerrors.NewNonRetryError(noaaerrors.NewUnauthorizedError("bad token"))))
+	assert.Equal(t, authFailure, classifyDisconnect(&rlpStatusError{statusCode: 401}))
+	assert.Equal(t, networkFailure, classifyDisconnect(&rlpStatusError{statusCode: 502}))
+	assert.Equal(t, networkFailure, classifyDisconnect(errors.New("dial tcp: i/o timeout")))
+}
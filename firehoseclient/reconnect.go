@@ -0,0 +1,79 @@
+package firehoseclient
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/utils"
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
+	"github.com/gorilla/websocket"
+)
+
+// ReconnectConfig bounds the reconnect loop of the nozzles.
+type ReconnectConfig struct {
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+	// MaxRetryCount is the number of consecutive failed reconnects before
+	// giving up, 0 retries forever.
+	MaxRetryCount int
+}
+
+type disconnectReason int
+
+const (
+	networkFailure disconnectReason = iota
+	normalClosure
+	authFailure
+	slowConsumer
+)
+
+// classifyDisconnect tells why the connection to the traffic controller or to
+// the RLP gateway was lost, looking through the errors wrapped by noaa.
+func classifyDisconnect(err error) disconnectReason {
+	switch e := err.(type) {
+	case noaaerrors.RetryError:
+		return classifyDisconnect(e.Err)
+	case noaaerrors.NonRetryError:
+		return classifyDisconnect(e.Err)
+	case *noaaerrors.UnauthorizedError:
+		return authFailure
+	case *rlpStatusError:
+		if e.statusCode == 401 || e.statusCode == 403 {
+			return authFailure
+		}
+		return networkFailure
+	}
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure):
+		return normalClosure
+	case websocket.IsCloseError(err, websocket.ClosePolicyViolation):
+		return slowConsumer
+	case err != nil && strings.Contains(err.Error(), "Error getting bearer token"):
+		return authFailure
+	}
+	return networkFailure
+}
+
+// waitBeforeReconnect sleeps for the next backoff delay, or returns false when
+// the maximum number of consecutive reconnects is reached or when the nozzle is
+// stopped.
+func waitBeforeReconnect(backoff *utils.Backoff, config ReconnectConfig, reconnects *uint64, source string, stopped context.Context) bool {
+	if config.MaxRetryCount > 0 && backoff.Attempts() >= config.MaxRetryCount {
+		logging.Error.Printf("Giving up reconnecting to the %s after %d consecutive attempts", source, backoff.Attempts())
+		return false
+	}
+	delay := backoff.Next()
+	total := atomic.AddUint64(reconnects, 1)
+	logging.Info.Printf("Reconnecting to the %s in %v (attempt %d, %d reconnects since start)", source, delay, backoff.Attempts(), total)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stopped.Done():
+		return false
+	}
+}
@@ -0,0 +1,208 @@
+package firehoseclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventRouting"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/utils"
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// RLPGatewayNozzle consumes loggregator v2 envelopes from the Reverse Log Proxy
+// gateway server-sent-events endpoint.
+type RLPGatewayNozzle struct {
+	eventRouting *eventRouting.EventRouting
+	config       *RLPGatewayConfig
+	cfClient     *cfclient.Client
+	httpClient   *http.Client
+	backoff      *utils.Backoff
+	reconnects   uint64
+	connected    int32
+	stopped      context.Context
+	stop         context.CancelFunc
+}
+
+type RLPGatewayConfig struct {
+	GatewayURL            string
+	InsecureSSLSkipVerify bool
+	ShardID               string
+	ReconnectConfig
+}
+
+// rlpStatusError is returned when the RLP gateway refuses the connection.
+type rlpStatusError struct {
+	statusCode int
+	body       string
+}
+
+func (e *rlpStatusError) Error() string {
+	return fmt.Sprintf("RLP gateway returned status code %d: %s", e.statusCode, e.body)
+}
+
+// selectorsByEvent lists the v2 envelope selectors needed by each v1 event type.
+var selectorsByEvent = map[string][]string{
+	"LogMessage":      {"log", "event"},
+	"CounterEvent":    {"counter"},
+	"ValueMetric":     {"gauge"},
+	"ContainerMetric": {"gauge"},
+	"HttpStartStop":   {"timer"},
+	"Gauge":           {"gauge"},
+	"Timer":           {"timer"},
+}
+
+func NewRLPGatewayNozzle(cfClient *cfclient.Client, eventRouting *eventRouting.EventRouting, config *RLPGatewayConfig) *RLPGatewayNozzle {
+	stopped, stop := context.WithCancel(context.Background())
+	return &RLPGatewayNozzle{
+		eventRouting: eventRouting,
+		config:       config,
+		cfClient:     cfClient,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureSSLSkipVerify},
+			},
+		},
+		backoff: utils.NewBackoff(config.MinRetryDelay, config.MaxRetryDelay),
+		stopped: stopped,
+		stop:    stop,
+	}
+}
+
+// Start reads the RLP gateway until it gives up reconnecting, returning the
+// last error, or until it is stopped, returning nil.
+func (r *RLPGatewayNozzle) Start() error {
+	logging.Info.Printf("Started the RLP Gateway Nozzle... \n")
+	for {
+		err := r.stream()
+		if r.stopped.Err() != nil {
+			logging.Info.Printf("Stopped reading the RLP gateway \n")
+			return nil
+		}
+		if classifyDisconnect(err) == authFailure {
+			logging.Error.Printf("Authentication error while reading from the RLP gateway: %v", err)
+			if !waitBeforeReconnect(r.backoff, r.config.ReconnectConfig, &r.reconnects, "RLP gateway", r.stopped) {
+				return err
+			}
+			r.cfClient = resetCfClient(r.cfClient)
+			continue
+		}
+		logging.Error.Printf("Error while reading from the RLP gateway: %v", err)
+		if !waitBeforeReconnect(r.backoff, r.config.ReconnectConfig, &r.reconnects, "RLP gateway", r.stopped) {
+			return err
+		}
+	}
+}
+
+// Stop closes the event stream and makes Start return.
+func (r *RLPGatewayNozzle) Stop() {
+	r.stop()
+}
+
+// Reconnects returns the number of reconnects to the RLP gateway since start.
+func (r *RLPGatewayNozzle) Reconnects() uint64 {
+	return atomic.LoadUint64(&r.reconnects)
+}
+
+// Connected reports whether the event stream of the RLP gateway is open.
+func (r *RLPGatewayNozzle) Connected() bool {
+	return atomic.LoadInt32(&r.connected) == 1
+}
+
+// ReadURL builds the /v2/read URL with the shard id and the selectors matching
+// the events selected for routing.
+func (r *RLPGatewayNozzle) ReadURL() string {
+	query := url.Values{}
+	query.Set("shard_id", r.config.ShardID)
+	for eventType, selected := range r.eventRouting.GetSelectedEvents() {
+		if !selected {
+			continue
+		}
+		for _, selector := range selectorsByEvent[eventType] {
+			query.Set(selector, "")
+		}
+	}
+	return strings.TrimRight(r.config.GatewayURL, "/") + "/v2/read?" + query.Encode()
+}
+
+func (r *RLPGatewayNozzle) stream() error {
+	token, err := r.cfClient.GetToken()
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(r.stopped, "GET", r.ReadURL(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", token)
+	request.Header.Set("Accept", "text/event-stream")
+
+	logging.Info.Printf("consume the RLP gateway... \n")
+	response, err := r.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return &rlpStatusError{statusCode: response.StatusCode, body: string(body)}
+	}
+	r.backoff.Reset()
+	atomic.StoreInt32(&r.connected, 1)
+	defer atomic.StoreInt32(&r.connected, 0)
+	return r.readEvents(response.Body)
+}
+
+// readEvents parses the server-sent-events stream and routes every envelope
+// of each data frame. It returns when the stream fails or is closed.
+func (r *RLPGatewayNozzle) readEvents(body io.Reader) error {
+	reader := bufio.NewReaderSize(body, 1024*1024)
+	var data bytes.Buffer
+	eventName := ""
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			if eventName == "closing" {
+				return fmt.Errorf("RLP gateway closed the stream")
+			}
+			if eventName != "heartbeat" && data.Len() > 0 {
+				r.routeBatch(data.Bytes())
+			}
+			data.Reset()
+			eventName = ""
+		case bytes.HasPrefix(line, []byte("event:")):
+			eventName = string(bytes.TrimSpace(line[len("event:"):]))
+		case bytes.HasPrefix(line, []byte("data:")):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(bytes.TrimSpace(line[len("data:"):]))
+		}
+	}
+}
+
+func (r *RLPGatewayNozzle) routeBatch(data []byte) {
+	envelopes, err := events.ParseEnvelopeBatchV2(data)
+	if err != nil {
+		logging.Error.Printf("Error decoding RLP gateway envelopes: %v", err)
+		return
+	}
+	for _, envelope := range envelopes {
+		r.eventRouting.RouteEnvelopeV2(envelope)
+	}
+}
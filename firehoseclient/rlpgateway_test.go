@@ -0,0 +1,84 @@
+package firehoseclient
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/caching"
+	. "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventQueue"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventRouting"
+	. "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+)
+
+func newTestRLPGatewayNozzle(wantedEvents string) (*RLPGatewayNozzle, *Queue) {
+	queue := NewQueue(make([]*Event, 10))
+	routing := eventRouting.NewEventRouting(caching.NewCachingEmpty(), []*Queue{&queue})
+	routing.SetupEventRouting(wantedEvents)
+	nozzle := NewRLPGatewayNozzle(nil, routing, &RLPGatewayConfig{
+		GatewayURL: "https://log-stream.sys.example.com/",
+		ShardID:    "sumo",
+	})
+	return nozzle, &queue
+}
+
+func TestRLPGatewayReadURL(t *testing.T) {
+	nozzle, _ := newTestRLPGatewayNozzle("LogMessage,ContainerMetric")
+	readURL := nozzle.ReadURL()
+
+	assert.True(t, strings.HasPrefix(readURL, "https://log-stream.sys.example.com/v2/read?"), readURL)
+	assert.Contains(t, readURL, "shard_id=sumo")
+	assert.Contains(t, readURL, "log=")
+	assert.Contains(t, readURL, "event=")
+	assert.Contains(t, readURL, "gauge=")
+	assert.NotContains(t, readURL, "counter=")
+	assert.NotContains(t, readURL, "timer=")
+}
+
+func TestRLPGatewayReadEvents(t *testing.T) {
+	nozzle, queue := newTestRLPGatewayNozzle("LogMessage,CounterEvent,ContainerMetric")
+	stream := "event: heartbeat\ndata: {}\n\n" +
+		`data: {"batch":[{"timestamp":"1483629662001580569","sourceId":"7833dc75-4484-409c-9b74-90b6454906c6","instanceId":"0",` +
+		`"tags":{"source_type":"APP/PROC/WEB","deployment":"cf","job":"diego_cell","index":"c62aebe5","ip":"10.0.0.1"},` +
+		`"log":{"payload":"aGVsbG8gd29ybGQ=","type":"ERR"}},` +
+		`{"timestamp":"1483629662001580569","sourceId":"doppler","tags":{"origin":"loggregator.doppler"},"counter":{"name":"dropped","delta":"3","total":"42"}}]}` + "\n\n" +
+		`data: {"batch":[{"timestamp":"1483629662001580569","sourceId":"7833dc75-4484-409c-9b74-90b6454906c6","instanceId":"2","gauge":{"metrics":{` +
+		`"cpu":{"unit":"percentage","value":1.5},"memory":{"unit":"bytes","value":1024},"disk":{"unit":"bytes","value":2048},` +
+		`"memory_quota":{"unit":"bytes","value":4096},"disk_quota":{"unit":"bytes","value":8192}}}}]}` + "\n\n"
+
+	err := nozzle.readEvents(strings.NewReader(stream))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 3, queue.GetCount())
+
+	logMessage := queue.Pop()
+	assert.Equal(t, "LogMessage", logMessage.Type)
+	assert.Equal(t, "hello world", logMessage.Msg)
+	assert.Equal(t, "ERR", logMessage.Fields["message_type"])
+	assert.Equal(t, "APP/PROC/WEB", logMessage.Fields["source_type"])
+	assert.Equal(t, "diego_cell", logMessage.Fields["job"])
+	assert.Equal(t, "c62aebe5", logMessage.Fields["job_index"])
+	assert.Equal(t, "7833dc75-4484-409c-9b74-90b6454906c6", logMessage.Fields["origin"])
+	assert.Equal(t, int64(1483629662001580569), logMessage.Fields["timestamp"])
+
+	counterEvent := queue.Pop()
+	assert.Equal(t, "CounterEvent", counterEvent.Type)
+	assert.Equal(t, "loggregator.doppler", counterEvent.Fields["origin"])
+	assert.Equal(t, uint64(3), counterEvent.Fields["delta"])
+	assert.Equal(t, uint64(42), counterEvent.Fields["total"])
+
+	containerMetric := queue.Pop()
+	assert.Equal(t, "ContainerMetric", containerMetric.Type)
+	assert.Equal(t, 1.5, containerMetric.Fields["cpu_percentage"])
+	assert.Equal(t, uint64(4096), containerMetric.Fields["memory_bytes_quota"])
+	assert.Equal(t, int32(2), containerMetric.Fields["instance_index"])
+}
+
+func TestRLPGatewayReadEventsClosing(t *testing.T) {
+	nozzle, queue := newTestRLPGatewayNozzle("LogMessage")
+	err := nozzle.readEvents(strings.NewReader("event: closing\ndata: {}\n\n"))
+
+	assert.EqualError(t, err, "RLP gateway closed the stream")
+	assert.Equal(t, 0, queue.GetCount())
+}
@@ -0,0 +1,83 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Check returns an error describing why a component is not healthy.
+type Check func() error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker answers the liveness and readiness probes of the platform. An
+// instance is ready when all of its liveness and readiness checks pass.
+type Checker struct {
+	mutex     *sync.Mutex
+	liveness  []namedCheck
+	readiness []namedCheck
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		mutex: &sync.Mutex{},
+	}
+}
+
+// AddLivenessCheck adds a check that fails when the process must be restarted.
+func (c *Checker) AddLivenessCheck(name string, check Check) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.liveness = append(c.liveness, namedCheck{name: name, check: check})
+}
+
+// AddReadinessCheck adds a check that fails while the process is not doing its
+// job, e.g. during startup or when a dependency is unreachable.
+func (c *Checker) AddReadinessCheck(name string, check Check) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readiness = append(c.readiness, namedCheck{name: name, check: check})
+}
+
+// LivenessHandler serves the liveness checks, usually on /healthz.
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.mutex.Lock()
+		checks := append([]namedCheck{}, c.liveness...)
+		c.mutex.Unlock()
+		serveChecks(w, checks)
+	})
+}
+
+// ReadinessHandler serves the liveness and readiness checks, usually on /readyz.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.mutex.Lock()
+		checks := append(append([]namedCheck{}, c.liveness...), c.readiness...)
+		c.mutex.Unlock()
+		serveChecks(w, checks)
+	})
+}
+
+// serveChecks answers 200 when all the checks pass and 503 otherwise, with
+// one line per check in the body.
+func serveChecks(w http.ResponseWriter, checks []namedCheck) {
+	lines := make([]string, 0, len(checks))
+	status := http.StatusOK
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			status = http.StatusServiceUnavailable
+			lines = append(lines, fmt.Sprintf("%s: %v", c.name, err))
+		} else {
+			lines = append(lines, c.name+": ok")
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
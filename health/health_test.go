@@ -0,0 +1,54 @@
+package health
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func probe(checker *Checker, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", path, nil)
+	if path == "/healthz" {
+		checker.LivenessHandler().ServeHTTP(recorder, request)
+	} else {
+		checker.ReadinessHandler().ServeHTTP(recorder, request)
+	}
+	return recorder
+}
+
+func TestHealthyChecker(t *testing.T) {
+	checker := NewChecker()
+	checker.AddLivenessCheck("appenders", func() error { return nil })
+	checker.AddReadinessCheck("firehose", func() error { return nil })
+
+	liveness := probe(checker, "/healthz")
+	assert.Equal(t, 200, liveness.Code)
+	assert.Equal(t, "appenders: ok\n", liveness.Body.String())
+
+	readiness := probe(checker, "/readyz")
+	assert.Equal(t, 200, readiness.Code)
+	assert.Equal(t, "appenders: ok\nfirehose: ok\n", readiness.Body.String())
+}
+
+func TestFailingReadinessCheckKeepsLiveness(t *testing.T) {
+	checker := NewChecker()
+	checker.AddLivenessCheck("appenders", func() error { return nil })
+	checker.AddReadinessCheck("firehose", func() error { return errors.New("not connected") })
+
+	assert.Equal(t, 200, probe(checker, "/healthz").Code)
+
+	readiness := probe(checker, "/readyz")
+	assert.Equal(t, 503, readiness.Code)
+	assert.Contains(t, readiness.Body.String(), "firehose: not connected")
+}
+
+func TestFailingLivenessCheckFailsReadiness(t *testing.T) {
+	checker := NewChecker()
+	checker.AddLivenessCheck("appenders", func() error { return errors.New("appender 0 stopped") })
+
+	assert.Equal(t, 503, probe(checker, "/healthz").Code)
+	assert.Equal(t, 503, probe(checker, "/readyz").Code)
+}
@@ -3,6 +3,10 @@ package logging
 import (
 	"io"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -12,29 +16,108 @@ var (
 	Error   *log.Logger
 )
 
+// Mask replaces the secrets in the log output.
+const Mask = "********"
+
+// minSecretLength is the length under which a secret is too likely to appear
+// in unrelated text, like a word of a log line, to be masked everywhere.
+const minSecretLength = 8
+
+var (
+	secretsMutex sync.Mutex
+	secrets      []string
+	shortSecrets sync.Map     // string -> struct{}
+	redactor     atomic.Value // *strings.Replacer
+)
+
 func Init(
 	traceHandle io.Writer,
 	infoHandle io.Writer,
 	warningHandle io.Writer,
 	errorHandle io.Writer) {
 
-	Trace = log.New(traceHandle,
+	Trace = log.New(redacting(traceHandle),
 		"TRACE: ",
 		log.Ldate|log.Ltime|log.Lshortfile)
 
-	Info = log.New(infoHandle,
+	Info = log.New(redacting(infoHandle),
 		"INFO: ",
 		log.Ldate|log.Ltime|log.Lshortfile)
 
-	Warning = log.New(warningHandle,
+	Warning = log.New(redacting(warningHandle),
 		"WARNING: ",
 		log.Ldate|log.Ltime|log.Lshortfile)
 
-	Error = log.New(errorHandle,
+	Error = log.New(redacting(errorHandle),
 		"ERROR: ",
 		log.Ldate|log.Ltime|log.Lshortfile)
 }
 
+// AddSecret masks a value, like a password or an endpoint URL, in the log
+// output written from then on. Empty values are ignored, and values shorter
+// than minSecretLength are only masked by Redact when they are the whole text.
+func AddSecret(secret string) {
+	if secret == "" || secret == Mask {
+		return
+	}
+	if len(secret) < minSecretLength {
+		if _, known := shortSecrets.LoadOrStore(secret, struct{}{}); !known && Warning != nil {
+			Warning.Printf("A secret of %d characters, shorter than %d, is not masked in the log lines", len(secret), minSecretLength)
+		}
+		return
+	}
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	for _, known := range secrets {
+		if known == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+	// longest first, so that a secret containing another one is fully masked
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, known := range secrets {
+		pairs = append(pairs, known, Mask)
+	}
+	redactor.Store(strings.NewReplacer(pairs...))
+}
+
+// Redact returns text with the secrets masked, including a short secret that
+// is the whole text.
+func Redact(text string) string {
+	if _, short := shortSecrets.Load(text); short {
+		return Mask
+	}
+	if replacer, _ := redactor.Load().(*strings.Replacer); replacer != nil {
+		return replacer.Replace(text)
+	}
+	return text
+}
+
+// redactingWriter masks the secrets of each log line before writing it.
+type redactingWriter struct {
+	out io.Writer
+}
+
+func redacting(out io.Writer) io.Writer {
+	if out == io.Discard {
+		return out
+	}
+	return redactingWriter{out: out}
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	replacer, _ := redactor.Load().(*strings.Replacer)
+	if replacer == nil {
+		return w.out.Write(p)
+	}
+	if _, err := io.WriteString(w.out, replacer.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 /*func main() {
     Init(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
 
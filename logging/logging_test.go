@@ -0,0 +1,42 @@
+package logging
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretsAreMasked(t *testing.T) {
+	var out bytes.Buffer
+	Init(io.Discard, &out, &out, &out)
+	Info.Println("before: long-s3cr3t")
+
+	AddSecret("long-s3cr3t")
+	AddSecret("https://collectors.sumologic.com/receiver/v1/http/token-long-s3cr3t-suffix")
+	AddSecret("")
+	Info.Println("password: long-s3cr3t")
+	Error.Printf("Post %q: timeout", "https://collectors.sumologic.com/receiver/v1/http/token-long-s3cr3t-suffix")
+
+	assert.Contains(t, out.String(), "before: long-s3cr3t", "the secrets are masked from then on")
+	assert.Contains(t, out.String(), "password: "+Mask+"\n")
+	assert.Contains(t, out.String(), `Post "`+Mask+`": timeout`)
+	assert.Equal(t, "an "+Mask+" value", Redact("an long-s3cr3t value"))
+}
+
+func TestShortSecretsAreOnlyMaskedAsAWhole(t *testing.T) {
+	var out bytes.Buffer
+	Init(io.Discard, &out, &out, &out)
+
+	AddSecret("admin")
+	AddSecret("admin")
+	Info.Println("the admin user")
+
+	assert.Equal(t, 1, strings.Count(out.String(), "WARNING: "), "short secrets are reported once")
+	assert.NotContains(t, out.String(), "admin\n", "the warning does not print the secret")
+	assert.Contains(t, out.String(), "the admin user\n")
+	assert.Equal(t, Mask, Redact("admin"))
+	assert.Equal(t, "the admin user", Redact("the admin user"))
+}
@@ -2,17 +2,25 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/caching"
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventQueue"
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventRouting"
-	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/firehoseclient"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/health"
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/metrics"
 
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/sumoCFFirehose"
 	"github.com/alecthomas/kingpin/v2"
@@ -25,47 +33,103 @@ var (
 	subscriptionId             = kingpin.Flag("subscription_id", "Cloud Foundry ID for the subscription.").Default("firehose").Envar("FIREHOSE_SUBSCRIPTION_ID").String()
 	user                       = kingpin.Flag("cloudfoundry_user", "Cloud Foundry User").Envar("CLOUDFOUNDRY_USER").String() //user created in CF, authorized to connect the firehose
 	password                   = kingpin.Flag("cloudfoundry_password", "Cloud Foundry Password").Envar("CLOUDFOUNDRY_PASSWORD").String()
+	clientID                   = kingpin.Flag("cloudfoundry_client_id", "UAA client ID, with the doppler.firehose and cloud_controller.admin_read_only scopes. When set, it is used instead of the Cloud Foundry User").Envar("CLOUDFOUNDRY_CLIENT_ID").String()
+	clientSecret               = kingpin.Flag("cloudfoundry_client_secret", "UAA client secret").Envar("CLOUDFOUNDRY_CLIENT_SECRET").String()
 	keepAlive, errDt           = time.ParseDuration("25s") //default Error,ContainerMetric,HttpStart,HttpStop,HttpStartStop,LogMessage,ValueMetric,CounterEvent
 	defaultPostMinimumDelay, _ = time.ParseDuration("2000ms")
+	defaultFlushInterval       = 10 * time.Second
+	defaultMaxRetryDuration    = time.Minute
 	wantedEvents               = kingpin.Flag("events", fmt.Sprintf("Comma separated list of events you would like. Valid options are %s", eventRouting.GetListAuthorizedEventEvents())).Default("LogMessage").Envar("EVENTS").String()
 	boltDatabasePath           = "event.db"
 	skipSSLValidation          = kingpin.Flag("skip_ssl_validation", "Skip SSL validation (to allow things like self-signed certs). Do not set to true in production").Default("false").Envar("SKIP_SSL_VALIDATION").Bool()
 	tickerTime                 = kingpin.Flag("nozzle_polling_period", "How frequently this Nozzle polls the CF Firehose for data").Default("5m").Envar("NOZZLE_POLLING_PERIOD").Duration()
 	eventsBatchSize            = kingpin.Flag("log_events_batch_size", "When number of messages in the buffer is equal to this flag, send those to Sumo Logic").Default("500").Envar("LOG_EVENTS_BATCH_SIZE").Int()
 	verboseLogMessages         = kingpin.Flag("verbose_log_messages", "Enable Verbose in 'LogMessage' Event. If this flag NOT present, the LogMessage will contain ONLY the fields: tiemstamp, cf_app_guid, Msg").Default("true").Envar("VERBOSE_LOG_MESSAGES").Bool()
+	httpPairingWindow          = kingpin.Flag("http_start_stop_pairing_window", "When greater than 0, HttpStart and HttpStop events of the same request seen within this window are sent as a single HttpStartStop event").Default("0s").Envar("HTTP_START_STOP_PAIRING_WINDOW").Duration()
+	envelopeTagsPrefix         = kingpin.Flag("envelope_tags_prefix", "Prefix added to the field names of the envelope tags").Default("").Envar("ENVELOPE_TAGS_PREFIX").String()
+	envelopeTagsInclude        = kingpin.Flag("envelope_tags_include", "Comma separated list of envelope tags added to the events. If empty, all the tags are added").Default("").Envar("ENVELOPE_TAGS_INCLUDE").String()
+	envelopeTagsExclude        = kingpin.Flag("envelope_tags_exclude", "Comma separated list of envelope tags never added to the events").Default("").Envar("ENVELOPE_TAGS_EXCLUDE").String()
+	reconnectMinDelay          = kingpin.Flag("reconnect_min_delay", "Minimum delay before reconnecting to the firehose or the RLP gateway. The delay doubles, with jitter, on each consecutive failure").Default("1s").Envar("RECONNECT_MIN_DELAY").Duration()
+	reconnectMaxDelay          = kingpin.Flag("reconnect_max_delay", "Maximum delay before reconnecting to the firehose or the RLP gateway").Default("60s").Envar("RECONNECT_MAX_DELAY").Duration()
+	reconnectMaxAttempts       = kingpin.Flag("reconnect_max_attempts", "Number of consecutive failed reconnects before the nozzle gives up. 0 retries forever").Default("0").Envar("RECONNECT_MAX_ATTEMPTS").Int()
+	droppedMessagesPeriod      = kingpin.Flag("dropped_messages_report_period", "How frequently the messages dropped by the dopplers because the nozzle is not keeping up are reported. 0 disables the report, which needs the unfiltered firehose when only LogMessage is selected").Default("1m").Envar("DROPPED_MESSAGES_REPORT_PERIOD").Duration()
+	maxBatchBytes              = kingpin.Flag("max_batch_bytes", "Maximum uncompressed size in bytes of each post of logs or of metrics. Longer log messages are truncated and marked with the 'truncated' field").Default("1000000").Envar("MAX_BATCH_BYTES").Int()
+	maxConcurrentPosts         = kingpin.Flag("max_concurrent_posts", "Maximum number of posts in flight to each endpoint. The events wait in the queue when all the senders are busy").Default("4").Envar("MAX_CONCURRENT_POSTS").Int()
+	circuitBreakerFailures     = kingpin.Flag("circuit_breaker_failures", "Number of consecutive failed posts after which the posts to an endpoint are paused. 0 disables the circuit breaker").Default("5").Envar("CIRCUIT_BREAKER_FAILURES").Int()
+	circuitBreakerOpenPeriod   = kingpin.Flag("circuit_breaker_open_period", "How long the posts to an endpoint are paused before a single post probes whether it recovered").Default("30s").Envar("CIRCUIT_BREAKER_OPEN_PERIOD").Duration()
+	spoolDirectory             = kingpin.Flag("spool_directory", "Directory where the batches are kept until they are delivered, and replayed from after an endpoint outage or a restart. Disabled when empty").Default("").Envar("SPOOL_DIRECTORY").String()
+	spoolMaxBytes              = kingpin.Flag("spool_max_bytes", "Maximum size in bytes of the spool of each endpoint, the oldest batches are dropped beyond it. 0 means no limit").Default("268435456").Envar("SPOOL_MAX_BYTES").Int64()
+	spoolMaxAge                = kingpin.Flag("spool_max_age", "Spooled batches older than this are dropped. 0 means no limit").Default("24h").Envar("SPOOL_MAX_AGE").Duration()
+	httpListenAddress          = kingpin.Flag("http_listen_address", "Address of the optional HTTP listener exposing the internal metrics on /metrics and the health checks on /healthz and /readyz (e.g. ':8080'). Disabled when empty").Default("").Envar("HTTP_LISTEN_ADDRESS").String()
+	queueMaxEvents             = kingpin.Flag("queue_max_events", "Maximum number of events waiting to be sent to each endpoint. 0 means no limit").Default("100000").Envar("QUEUE_MAX_EVENTS").Int()
+	queueMaxBytes              = kingpin.Flag("queue_max_bytes", "Maximum size in bytes of the events waiting to be sent to each endpoint. 0 means no limit").Default("0").Envar("QUEUE_MAX_BYTES").Int()
+	queueOverflowPolicy        = kingpin.Flag("queue_overflow_policy", "What to do with new events when a queue is full: 'drop-newest', 'drop-oldest' or 'block' (slows down the firehose reader)").Default("drop-oldest").Envar("QUEUE_OVERFLOW_POLICY").Enum("drop-newest", "drop-oldest", "block")
+	shutdownTimeout            = kingpin.Flag("shutdown_timeout", "On SIGTERM, how long the nozzle waits for the queued events and the posts in flight to be sent before it exits. Cloud Foundry kills the app 10 seconds after SIGTERM").Default("8s").Envar("SHUTDOWN_TIMEOUT").Duration()
+	readinessMaxPostAge        = kingpin.Flag("readiness_max_post_age", "The nozzle is reported as not ready on /readyz when the posts to an endpoint keep failing, without a successful one, for this long. 0 disables this check").Default("5m").Envar("READINESS_MAX_POST_AGE").Duration()
+	ingestionMode              = kingpin.Flag("ingestion_mode", "Where to read events from: 'firehose' (loggregator v1 websocket firehose) or 'rlp_gateway' (loggregator v2 Reverse Log Proxy gateway)").Default("firehose").Envar("INGESTION_MODE").Enum("firehose", "rlp_gateway")
+	configFile                 = kingpin.Flag("config", "YAML or JSON file holding the settings of the nozzle, named after the flags, and the list of sumo_endpoints. The flags and their environment variables override its values").Envar("CONFIG_FILE").String()
+	printConfigMode            = kingpin.Flag("print_config", "Print the effective configuration, in the format of the configuration file and with the secrets masked, then exit").Bool()
+	configReloadPeriod         = kingpin.Flag("config_reload_period", "How frequently the configuration file is checked for changes, reloading its sumo_endpoints when it changed. 0 only reloads them on SIGHUP").Default("0s").Envar("CONFIG_RELOAD_PERIOD").Duration()
+	rlpGatewayURL              = kingpin.Flag("rlp_gateway_url", "URL to the RLP gateway. If empty, it is derived from the CF API Endpoint (https://log-stream.<system domain>)").Envar("RLP_GATEWAY_URL").String()
 )
 
 var (
 	version = "1.0.9"
 )
 
+const spoolRetryPeriod = 30 * time.Second
+
 func main() {
 	//logging init
 	logging.Init(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
 
 	kingpin.Version(version)
+	if err := loadConfigFile(kingpin.CommandLine, os.Args[1:]); err != nil {
+		logging.Error.Fatal("Error loading the configuration file: ", err)
+	}
+	serviceSettings, err := loadVcapServices(kingpin.CommandLine, os.Getenv("VCAP_SERVICES"))
+	if err != nil {
+		logging.Error.Fatal("Error loading the service bindings: ", err)
+	}
+	if err := loadSecretFiles(kingpin.CommandLine); err != nil {
+		logging.Error.Fatal("Error reading the secret files: ", err)
+	}
 	kingpin.Parse()
 
 	sumoConfigs, err := parseSumoConfigs(*sumoEndpointsString)
 	if err != nil {
 		logging.Error.Fatal("Error parsing sumo configs: ", err.Error())
 	}
+	maskSecrets(sumoConfigs)
 	cfApi := parseCfApiFromVcapApplication(os.Getenv("VCAP_APPLICATION"))
 	if *apiEndpoint == "" {
-		logging.Info.Println("Cloud Foundry API Endpoint was empty. Setting it to cf_api value: " + cfApi)
+		if !*printConfigMode {
+			logging.Info.Println("Cloud Foundry API Endpoint was empty. Setting it to cf_api value: " + cfApi)
+		}
 		*apiEndpoint = cfApi
 	}
+	if *printConfigMode {
+		if err := printConfig(os.Stdout, kingpin.CommandLine, sumoConfigs); err != nil {
+			logging.Error.Fatal("Error printing the configuration: ", err)
+		}
+		return
+	}
 
 	logging.Info.Println("Set Configurations:")
+	logging.Info.Println("Configuration File: " + *configFile)
+	logging.Info.Printf("Settings from Service Bindings: %v", serviceSettings)
 	logging.Info.Println("cf_api: " + cfApi)
 	logging.Info.Println("CF API Endpoint: " + *apiEndpoint)
 	logging.Info.Println("Cloud Foundry Nozzle Subscription ID: " + *subscriptionId)
 	logging.Info.Println("Cloud Foundry User: " + *user)
+	logging.Info.Println("Cloud Foundry Client ID: " + *clientID)
 	logging.Info.Println("Events Selected: " + *wantedEvents)
 	logging.Info.Printf("Skip SSL Validation: %v", *skipSSLValidation)
 	logging.Info.Printf("Nozzle Polling Period: %v", *tickerTime)
 	logging.Info.Printf("Log Events Batch Size: [%d]", *eventsBatchSize)
 	logging.Info.Printf("Verbose Log Messages: %v\n", *verboseLogMessages)
+	logging.Info.Println("Ingestion Mode: " + *ingestionMode)
+	logging.Info.Printf("Reconnect Delay: %v to %v, Max Attempts: %d", *reconnectMinDelay, *reconnectMaxDelay, *reconnectMaxAttempts)
 	logging.Info.Printf("Sumo Logic Configurations: %v", sumoConfigs)
 	logging.Info.Println("Starting Sumo Logic Nozzle " + version)
 
@@ -73,13 +137,7 @@ func main() {
 		logging.Info.Println("Could not parse Duration...")
 	}
 
-	c := cfclient.Config{
-		ApiAddress:        *apiEndpoint,
-		Username:          *user,
-		Password:          *password,
-		SkipSslValidation: *skipSSLValidation,
-	}
-	cfClient, errCfClient := cfclient.NewClient(&c)
+	cfClient, errCfClient := newCfClient()
 
 	if errCfClient != nil {
 		logging.Error.Fatal("Error setting up CF Client: ", errCfClient)
@@ -87,35 +145,100 @@ func main() {
 
 	//Creating Caching
 	var cachingClient caching.Caching
-	if caching.IsNeeded(*wantedEvents) {
+	allEvents := []string{*wantedEvents}
+	for _, sumoConfig := range sumoConfigs {
+		allEvents = append(allEvents, sumoConfig.Events)
+	}
+	if caching.IsNeeded(strings.Join(allEvents, ",")) {
 		cachingClient = caching.NewCachingBolt(cfClient, boltDatabasePath)
 	} else {
 		cachingClient = caching.NewCachingEmpty()
 	}
 
-	queues := make([]*eventQueue.Queue, len(sumoConfigs))
-	for i, sumoConfig := range sumoConfigs {
-		logging.Info.Println("Creating queue for endpoint: " + sumoConfig.Endpoint)
-		queue := eventQueue.NewQueue(make([]*events.Event, 100))
-		queues[i] = &queue
-
-		postMinDelay, errDPt := time.ParseDuration(sumoConfig.PostMinimumDelay)
-		if errDPt != nil {
-			logging.Info.Println("Error parsing PostMinimumDelay, got: " + sumoConfig.PostMinimumDelay + ". Will be using default value of 2s instead")
-			postMinDelay = defaultPostMinimumDelay
-		}
-		logging.Info.Printf("Using post minimum delay: %v\n", postMinDelay)
-		loggingClientSumo := sumoCFFirehose.NewSumoLogicAppender(sumoConfig.Endpoint, 5000, &queue, *eventsBatchSize, postMinDelay, sumoConfig.Category, sumoConfig.Name, sumoConfig.Host, *verboseLogMessages, sumoConfig.CustomMetadata, sumoConfig.IncludeOnlyMatchingFilter, sumoConfig.ExcludeAlwaysMatchingFilter, version)
-		go loggingClientSumo.Start() //multi
+	overflowPolicy, err := eventQueue.ParseOverflowPolicy(*queueOverflowPolicy)
+	if err != nil {
+		logging.Error.Fatal("Error parsing the queue overflow policy: ", err)
+	}
+	logging.Info.Printf("Queue limits: %d events, %d bytes, overflow policy: %s", *queueMaxEvents, *queueMaxBytes, overflowPolicy)
+	endpoints := newEndpointSet(overflowPolicy)
+	if err := endpoints.start(sumoConfigs); err != nil {
+		logging.Error.Fatal("Error creating the endpoints: ", err)
 	}
 
 	logging.Info.Println("Creating Events")
-	events := eventRouting.NewEventRouting(cachingClient, queues)
+	events := eventRouting.NewEventRouting(cachingClient, endpoints.queues())
 	err = events.SetupEventRouting(*wantedEvents)
 	if err != nil {
 		logging.Error.Fatal("Error setting up event routing: ", err)
 		os.Exit(1)
 	}
+	err = events.SetupQueueEvents(allEvents[1:])
+	if err != nil {
+		logging.Error.Fatal("Error setting up the events of the endpoints: ", err)
+	}
+	if *droppedMessagesPeriod > 0 {
+		events.SetupDroppedMessagesReport(*droppedMessagesPeriod)
+	}
+	events.SetupTagsPropagation(*envelopeTagsPrefix, *envelopeTagsInclude, *envelopeTagsExclude)
+	if *httpPairingWindow > 0 {
+		logging.Info.Printf("Pairing HttpStart and HttpStop events within: %v", *httpPairingWindow)
+		events.SetupHttpPairing(*httpPairingWindow)
+	}
+	endpoints.routing = events
+	reloadPath := *configFile
+	if reloadPath != "" && (endpointsOverridden(kingpin.CommandLine, os.Args[1:]) || serviceSettings["sumo_endpoints"] != "") {
+		logging.Warning.Println("The endpoints are set by --sumo_endpoints, SUMO_ENDPOINTS, SUMO_ENDPOINTS_FILE or a service binding, they are not reloaded from the configuration file")
+		reloadPath = ""
+	}
+	go endpoints.watchConfigFile(reloadPath, *configReloadPeriod)
+
+	reconnectConfig := firehoseclient.ReconnectConfig{
+		MinRetryDelay: *reconnectMinDelay,
+		MaxRetryDelay: *reconnectMaxDelay,
+		MaxRetryCount: *reconnectMaxAttempts,
+	}
+	var nozzle firehoseclient.Nozzle
+	if *ingestionMode == "rlp_gateway" {
+		if *rlpGatewayURL == "" {
+			*rlpGatewayURL = rlpGatewayURLFromApi(*apiEndpoint)
+		}
+		rlpGatewayConfig := &firehoseclient.RLPGatewayConfig{
+			GatewayURL:            *rlpGatewayURL,
+			InsecureSSLSkipVerify: *skipSSLValidation,
+			ShardID:               *subscriptionId,
+			ReconnectConfig:       reconnectConfig,
+		}
+
+		logging.Info.Printf("Connecting to RLP Gateway %s... \n", *rlpGatewayURL)
+		nozzle = firehoseclient.NewRLPGatewayNozzle(cfClient, events, rlpGatewayConfig)
+	} else {
+		firehoseConfig := &firehoseclient.FirehoseConfig{
+			TrafficControllerURL:   cfClient.Endpoint.DopplerEndpoint,
+			InsecureSSLSkipVerify:  *skipSSLValidation,
+			IdleTimeoutSeconds:     keepAlive,
+			FirehoseSubscriptionID: *subscriptionId,
+			ReconnectConfig:        reconnectConfig,
+		}
+
+		logging.Info.Printf("Connecting to Firehose... \n")
+		nozzle = firehoseclient.NewFirehoseNozzle(cfClient, events, firehoseConfig)
+	}
+
+	var cacheWarmedAt int64
+	if *httpListenAddress != "" {
+		registry := metrics.NewRegistry()
+		registerInternalMetrics(registry, events, endpoints.appenders, cachingClient, nozzle)
+		checker := health.NewChecker()
+		registerHealthChecks(checker, endpoints.appenders, &cacheWarmedAt, nozzle, *readinessMaxPostAge)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		mux.Handle("/healthz", checker.LivenessHandler())
+		mux.Handle("/readyz", checker.ReadinessHandler())
+		logging.Info.Printf("Serving internal metrics and health checks on %s", *httpListenAddress)
+		go func() {
+			logging.Error.Printf("HTTP listener error: %v", http.ListenAndServe(*httpListenAddress, mux))
+		}()
+	}
 
 	// Parse extra fields from cmd call
 	cachingClient.CreateBucket()
@@ -129,61 +252,195 @@ func main() {
 		logging.Info.Printf("[%d] "+apps[i].Name+" GUID: "+apps[i].Guid, i+1)
 	}
 	cachingClient.PerformPoollingCaching(*tickerTime)
+	atomic.StoreInt64(&cacheWarmedAt, time.Now().UnixNano())
 
-	firehoseConfig := &firehoseclient.FirehoseConfig{
-		TrafficControllerURL:   cfClient.Endpoint.DopplerEndpoint,
-		InsecureSSLSkipVerify:  *skipSSLValidation,
-		IdleTimeoutSeconds:     keepAlive,
-		FirehoseSubscriptionID: *subscriptionId,
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM, syscall.SIGINT)
+	nozzleDone := make(chan error, 1)
+	go func() {
+		nozzleDone <- nozzle.Start()
+	}()
+	select {
+	case sig := <-terminate:
+		logging.Info.Printf("Received %v, shutting down", sig)
+		nozzle.Stop()
+		<-nozzleDone
+	case errFirehose := <-nozzleDone:
+		logging.Info.Printf("FirehoseClient Error: %v", errFirehose)
 	}
 
-	logging.Info.Printf("Connecting to Firehose... \n")
-	firehoseClient := firehoseclient.NewFirehoseNozzle(cfClient, events, firehoseConfig)
-	errFirehose := firehoseClient.Start()
-	logging.Info.Printf("FirehoseClient Error: %v", errFirehose)
-	defer cachingClient.Close()
+	// Ordered shutdown: the events routed so far are sent before the cache is closed.
+	events.Stop()
+	endpoints.shutdown(*shutdownTimeout)
+	cachingClient.Close()
+	logging.Info.Println("Sumo Logic Nozzle stopped")
+}
+
+// registerInternalMetrics exposes the counters of the nozzle components.
+// Endpoints are labeled by their position in the current endpoints list, since
+// their URLs contain the collector token.
+func registerInternalMetrics(registry *metrics.Registry, events *eventRouting.EventRouting, appenders func() []*sumoCFFirehose.SumoLogicAppender, cachingClient caching.Caching, nozzle firehoseclient.Nozzle) {
+	registry.Register("sumo_nozzle_envelopes_received_total", "Events routed to the Sumo Logic endpoints, by event type.", metrics.Counter, func() []metrics.Sample {
+		samples := []metrics.Sample{}
+		for eventType, count := range events.GetSelectedEventsCount() {
+			if eventType != "ignored_app_message" {
+				samples = append(samples, metrics.Sample{Labels: map[string]string{"event_type": eventType}, Value: float64(count)})
+			}
+		}
+		return samples
+	})
+	registry.RegisterValue("sumo_nozzle_events_ignored_total", "Events not sent because their app opted out with F2S_DISABLE_LOGGING.", metrics.Counter, func() float64 {
+		return float64(events.GetSelectedEventsCount()["ignored_app_message"])
+	})
 
+	appenderSamples := func(value func(appender *sumoCFFirehose.SumoLogicAppender) float64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			current := appenders()
+			samples := make([]metrics.Sample, len(current))
+			for i, appender := range current {
+				samples[i] = metrics.Sample{Labels: map[string]string{"endpoint": strconv.Itoa(i)}, Value: value(appender)}
+			}
+			return samples
+		}
+	}
+	registry.Register("sumo_nozzle_queue_depth", "Events waiting to be sent, by endpoint.", metrics.Gauge, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		return float64(appender.QueueSize())
+	}))
+	registry.Register("sumo_nozzle_queue_dropped_total", "Events dropped because the queue was full, by endpoint.", metrics.Counter, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		return float64(appender.QueueDropped())
+	}))
+	registry.Register("sumo_nozzle_posts_in_flight", "Batches being posted, by endpoint.", metrics.Gauge, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		return float64(appender.InFlightPosts())
+	}))
+	registry.Register("sumo_nozzle_circuit_breaker_state", "State of the circuit breaker of the endpoint: 0 closed, 1 open, 2 half-open.", metrics.Gauge, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		return float64(appender.CircuitState())
+	}))
+	registry.Register("sumo_nozzle_posts_sent_total", "Successful posts, by endpoint.", metrics.Counter, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		return float64(appender.Stats().PostsSent)
+	}))
+	registry.Register("sumo_nozzle_posts_failed_total", "Posts dropped after their retries, by endpoint.", metrics.Counter, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		return float64(appender.Stats().PostsFailed)
+	}))
+	registry.Register("sumo_nozzle_posts_retried_total", "Post retries, by endpoint.", metrics.Counter, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		return float64(appender.Stats().PostsRetried)
+	}))
+	registry.Register("sumo_nozzle_bytes_sent_total", "Uncompressed bytes successfully posted, by endpoint.", metrics.Counter, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		return float64(appender.Stats().BytesSent)
+	}))
+
+	registry.Register("sumo_nozzle_spool_batches", "Batches waiting in the spool, by endpoint.", metrics.Gauge, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		batches, _, _ := appender.SpoolStats()
+		return float64(batches)
+	}))
+	registry.Register("sumo_nozzle_spool_bytes", "Size of the batches waiting in the spool, by endpoint.", metrics.Gauge, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		_, bytes, _ := appender.SpoolStats()
+		return float64(bytes)
+	}))
+	registry.Register("sumo_nozzle_spool_dropped_total", "Batches dropped from the spool because it was full or they expired, by endpoint.", metrics.Counter, appenderSamples(func(appender *sumoCFFirehose.SumoLogicAppender) float64 {
+		_, _, dropped := appender.SpoolStats()
+		return float64(dropped)
+	}))
+
+	registry.RegisterValue("sumo_nozzle_cache_hits_total", "App lookups served from the app/space/org cache.", metrics.Counter, func() float64 {
+		hits, _ := cachingClient.CacheStats()
+		return float64(hits)
+	})
+	registry.RegisterValue("sumo_nozzle_cache_misses_total", "App lookups sent to the Cloud Controller.", metrics.Counter, func() float64 {
+		_, misses := cachingClient.CacheStats()
+		return float64(misses)
+	})
+	registry.RegisterValue("sumo_nozzle_firehose_reconnects_total", "Reconnects to the firehose or the RLP gateway.", metrics.Counter, func() float64 {
+		return float64(nozzle.Reconnects())
+	})
 }
 
-type sumoConfigStruct struct {
-	Endpoint                    string `json:"endpoint"`
-	PostMinimumDelay            string `json:"sumo_post_minimum_delay"`
-	Category                    string `json:"sumo_category"`
-	Name                        string `json:"sumo_name"`
-	Host                        string `json:"sumo_host"`
-	CustomMetadata              string `json:"custom_metadata"`
-	IncludeOnlyMatchingFilter   string `json:"include_only_matching_filter"`
-	ExcludeAlwaysMatchingFilter string `json:"exclude_always_matching_filter"`
-	GUID                        string `json:"guid"`
+// registerHealthChecks adds the checks served on /healthz and /readyz. The
+// nozzle is alive while its appenders run, and ready once the app cache is
+// filled, the firehose is connected and no endpoint has had its posts failing,
+// without a successful one, for longer than maxPostAge. An endpoint with
+// nothing to send stays ready.
+func registerHealthChecks(checker *health.Checker, appenders func() []*sumoCFFirehose.SumoLogicAppender, cacheWarmedAt *int64, nozzle firehoseclient.Nozzle, maxPostAge time.Duration) {
+	checker.AddLivenessCheck("appenders", func() error {
+		for i, appender := range appenders() {
+			if !appender.Running() {
+				return fmt.Errorf("appender of endpoint %d is not running", i)
+			}
+		}
+		return nil
+	})
+
+	checker.AddReadinessCheck("cache", func() error {
+		if atomic.LoadInt64(cacheWarmedAt) == 0 {
+			return errors.New("app cache is being filled")
+		}
+		return nil
+	})
+	checker.AddReadinessCheck("firehose", func() error {
+		if !nozzle.Connected() {
+			return errors.New("not connected")
+		}
+		return nil
+	})
+	if maxPostAge <= 0 {
+		return
+	}
+	checker.AddReadinessCheck("sumo_posts", func() error {
+		for i, appender := range appenders() {
+			failingSince := appender.FailingSince()
+			if failingSince.IsZero() {
+				continue
+			}
+			if age := time.Since(failingSince); age > maxPostAge {
+				return fmt.Errorf("posts to endpoint %d failing for %v, circuit breaker %v", i, age.Round(time.Second), appender.CircuitState())
+			}
+		}
+		return nil
+	})
 }
 
-func (s sumoConfigStruct) String() string {
-	return fmt.Sprintf("\n"+
-		"Sumo Logic Endpoint: %v\n"+
-		"Sumo Logic HTTP Post Minimum Delay: %v\n"+
-		"Sumo Logic Name: %v\n"+
-		"Sumo Logic Host: %v\n"+
-		"Sumo Logic Category: %v\n"+
-		"Custom Metadata: %v\n"+
-		"Include Only Matching Filter: %v\n"+
-		"Exclude Always Matching Filter: %v\n",
-		s.Endpoint,
-		s.PostMinimumDelay,
-		s.Name,
-		s.Host,
-		s.Category,
-		s.CustomMetadata,
-		s.IncludeOnlyMatchingFilter,
-		s.ExcludeAlwaysMatchingFilter)
+// newCfClient authenticates as a UAA client when client credentials are set,
+// falling back to the password grant of the Cloud Foundry User.
+func newCfClient() (*cfclient.Client, error) {
+	var cfClient *cfclient.Client
+	var err error
+	for i, c := range cfClientConfigs() {
+		if i > 0 {
+			logging.Error.Printf("Error authenticating as UAA client %s, falling back to Cloud Foundry User: %v", *clientID, err)
+		}
+		cfClient, err = cfclient.NewClient(&c)
+		if err == nil && c.ClientID != "" {
+			// client credentials tokens are only requested on first use
+			_, err = cfClient.GetToken()
+		}
+		if err == nil {
+			break
+		}
+	}
+	return cfClient, err
 }
 
-func parseSumoConfigs(jsonString string) ([]sumoConfigStruct, error) {
-	res := []sumoConfigStruct{}
-	err := json.Unmarshal([]byte(jsonString), &res)
-	if err != nil {
-		return nil, err
+// cfClientConfigs returns the credentials newCfClient tries in order: the UAA
+// client when its ID is set, then the Cloud Foundry User when it is set or
+// there is no client.
+func cfClientConfigs() []cfclient.Config {
+	var configs []cfclient.Config
+	if *clientID != "" {
+		configs = append(configs, cfclient.Config{
+			ApiAddress:        *apiEndpoint,
+			ClientID:          *clientID,
+			ClientSecret:      *clientSecret,
+			SkipSslValidation: *skipSSLValidation,
+		})
 	}
-	return res, nil
+	if *clientID == "" || *user != "" {
+		configs = append(configs, cfclient.Config{
+			ApiAddress:        *apiEndpoint,
+			Username:          *user,
+			Password:          *password,
+			SkipSslValidation: *skipSSLValidation,
+		})
+	}
+	return configs
 }
 
 type vcapApplication struct {
@@ -211,3 +468,9 @@ func parseCfApiFromVcapApplication(jsonString string) string {
 	json.Unmarshal([]byte(jsonString), &res)
 	return res.CfApi
 }
+
+// rlpGatewayURLFromApi derives the RLP gateway URL from the CF API URL, both
+// being hosted on the system domain (api.<domain> and log-stream.<domain>).
+func rlpGatewayURLFromApi(apiEndpoint string) string {
+	return strings.Replace(apiEndpoint, "://api.", "://log-stream.", 1)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventQueue"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/health"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/sumoCFFirehose"
+	"github.com/stretchr/testify/assert"
+)
+
+func setCredentials(t *testing.T, id, secret, username, pass string) {
+	saved := []string{*clientID, *clientSecret, *user, *password, *apiEndpoint}
+	t.Cleanup(func() {
+		*clientID, *clientSecret, *user, *password, *apiEndpoint = saved[0], saved[1], saved[2], saved[3], saved[4]
+	})
+	*clientID, *clientSecret, *user, *password = id, secret, username, pass
+	*apiEndpoint = "https://api.sys.example.com"
+}
+
+func TestCfClientConfigsClientCredentials(t *testing.T) {
+	setCredentials(t, "nozzle", "client-secret", "", "")
+	configs := cfClientConfigs()
+	assert.Len(t, configs, 1)
+	assert.Equal(t, "https://api.sys.example.com", configs[0].ApiAddress)
+	assert.Equal(t, "nozzle", configs[0].ClientID)
+	assert.Equal(t, "client-secret", configs[0].ClientSecret)
+	assert.Empty(t, configs[0].Username)
+	assert.Empty(t, configs[0].Password)
+}
+
+func TestCfClientConfigsUserPassword(t *testing.T) {
+	setCredentials(t, "", "", "admin", "user-password")
+	configs := cfClientConfigs()
+	assert.Len(t, configs, 1)
+	assert.Equal(t, "admin", configs[0].Username)
+	assert.Equal(t, "user-password", configs[0].Password)
+	assert.Empty(t, configs[0].ClientID)
+	assert.Empty(t, configs[0].ClientSecret)
+}
+
+func TestCfClientConfigsFallBackToUser(t *testing.T) {
+	setCredentials(t, "nozzle", "client-secret", "admin", "user-password")
+	configs := cfClientConfigs()
+	assert.Len(t, configs, 2, "the UAA client is tried first")
+	assert.Equal(t, "nozzle", configs[0].ClientID)
+	assert.Empty(t, configs[0].Username)
+	assert.Equal(t, "admin", configs[1].Username)
+	assert.Equal(t, "user-password", configs[1].Password)
+	assert.Empty(t, configs[1].ClientID)
+}
+
+type connectedNozzle struct{}
+
+func (connectedNozzle) Start() error       { return nil }
+func (connectedNozzle) Stop()              {}
+func (connectedNozzle) Reconnects() uint64 { return 0 }
+func (connectedNozzle) Connected() bool    { return true }
+
+func TestReadinessFollowsFailingPosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	newAppender := func() *sumoCFFirehose.SumoLogicAppender {
+		queue := eventQueue.NewQueue(make([]*events.Event, 10))
+		return sumoCFFirehose.NewSumoLogicAppender(server.URL, 1000, &queue, 10, 0, time.Second, 0, "", "", "", true, "", "", "", "test")
+	}
+	idle, failing := newAppender(), newAppender()
+	for _, appender := range []*sumoCFFirehose.SumoLogicAppender{idle, failing} {
+		go appender.Start()
+		defer appender.Drain()
+	}
+	checker := health.NewChecker()
+	cacheWarmedAt := time.Now().UnixNano()
+	registerHealthChecks(checker, func() []*sumoCFFirehose.SumoLogicAppender { return []*sumoCFFirehose.SumoLogicAppender{idle, failing} }, &cacheWarmedAt, connectedNozzle{}, 200*time.Millisecond)
+	ready := func() int {
+		recorder := httptest.NewRecorder()
+		checker.ReadinessHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		return recorder.Code
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, ready(), "endpoints with nothing to send stay ready")
+
+	failing.SendToSumo("unavailable\n", server.URL, false)
+	assert.Equal(t, http.StatusOK, ready(), "a failure younger than the limit is tolerated")
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+)
+
+// Sample is one value of a metric, identified by its labels.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type metric struct {
+	name       string
+	help       string
+	metricType string
+	collect    func() []Sample
+}
+
+// Registry holds the nozzle internal metrics, each one collected from its
+// source when the registry is written.
+type Registry struct {
+	mutex   *sync.Mutex
+	metrics []*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Register adds a metric whose samples are returned by collect.
+func (r *Registry) Register(name string, help string, metricType string, collect func() []Sample) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, &metric{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		collect:    collect,
+	})
+}
+
+// RegisterValue adds a metric with a single unlabeled sample.
+func (r *Registry) RegisterValue(name string, help string, metricType string, value func() float64) {
+	r.Register(name, help, metricType, func() []Sample {
+		return []Sample{{Value: value()}}
+	})
+}
+
+// WriteTo writes all the metrics in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	metrics := make([]*metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mutex.Unlock()
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", m.name, m.metricType)
+		for _, sample := range m.collect() {
+			fmt.Fprintf(&buf, "%s%s %s\n", m.name, formatLabels(sample.Labels), strconv.FormatFloat(sample.Value, 'g', -1, 64))
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP exposes the registry, usually on /metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// labelEscaper escapes the only characters the Prometheus text format allows
+// to be escaped in label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
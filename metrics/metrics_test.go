@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteToPrometheusFormat(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register("sumo_nozzle_posts_sent_total", "Successful posts, by endpoint.", Counter, func() []Sample {
+		return []Sample{
+			{Labels: map[string]string{"endpoint": "0"}, Value: 12},
+			{Labels: map[string]string{"endpoint": "1"}, Value: 3},
+		}
+	})
+	registry.RegisterValue("sumo_nozzle_queue_depth", "Events waiting to be sent.", Gauge, func() float64 {
+		return 0.5
+	})
+
+	var buf bytes.Buffer
+	_, err := registry.WriteTo(&buf)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "# HELP sumo_nozzle_posts_sent_total Successful posts, by endpoint.\n"+
+		"# TYPE sumo_nozzle_posts_sent_total counter\n"+
+		"sumo_nozzle_posts_sent_total{endpoint=\"0\"} 12\n"+
+		"sumo_nozzle_posts_sent_total{endpoint=\"1\"} 3\n"+
+		"# HELP sumo_nozzle_queue_depth Events waiting to be sent.\n"+
+		"# TYPE sumo_nozzle_queue_depth gauge\n"+
+		"sumo_nozzle_queue_depth 0.5\n", buf.String())
+}
+
+func TestLabelsAreSortedAndQuoted(t *testing.T) {
+	assert.Equal(t, `{a="x",b="with \"quotes\""}`, formatLabels(map[string]string{"b": `with "quotes"`, "a": "x"}))
+	assert.Equal(t, "", formatLabels(nil))
+}
+
+func TestLabelValuesEscaping(t *testing.T) {
+	assert.Equal(t, `{a="back\\slash \"q\" new\nline	tab é"}`, formatLabels(map[string]string{"a": "back\\slash \"q\" new\nline\ttab é"}))
+}
+
+func TestServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	calls := 0
+	registry.RegisterValue("sumo_nozzle_cache_hits_total", "App lookups served from the cache.", Counter, func() float64 {
+		calls++
+		return float64(calls)
+	})
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	recorder = httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, recorder.Body.String(), "sumo_nozzle_cache_hits_total 2\n")
+}
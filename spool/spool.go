@@ -0,0 +1,208 @@
+package spool
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var batchesBucket = []byte("Batches")
+
+// Batch is a payload waiting to be delivered to a Sumo Logic endpoint.
+type Batch struct {
+	ID       uint64    `json:"-"`
+	Created  time.Time `json:"created"`
+	IsMetric bool      `json:"is_metric"`
+	Payload  string    `json:"payload"`
+	// Headers are the source headers the batch is posted with.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Spool keeps on disk the batches of one endpoint until they are delivered,
+// so that they survive an endpoint outage or a restart of the nozzle. Batches
+// are checked out while a sender posts them, and replayed oldest first.
+type Spool struct {
+	db       *bolt.DB
+	maxBytes int64
+	maxAge   time.Duration
+	mutex    *sync.Mutex
+	inFlight map[uint64]bool
+	count    int
+	bytes    int64
+	dropped  uint64
+}
+
+// Path returns the spool file of an endpoint in directory. The file is named
+// after a hash of the endpoint URL, which holds the collector token.
+func Path(directory string, endpoint string) string {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(endpoint)))
+	return filepath.Join(directory, "spool-"+hash[:16]+".db")
+}
+
+// Open opens or creates the spool at path. The spool holds at most maxBytes
+// bytes of payloads and batches older than maxAge, 0 meaning no limit.
+func Open(path string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		db:       db,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		mutex:    &sync.Mutex{},
+		inFlight: make(map[uint64]bool),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(batchesBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			s.count++
+			s.bytes += int64(len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write stores a batch and checks it out for the caller, which must call Done
+// once it tried to deliver it. The oldest batches are dropped when the spool is
+// full.
+func (s *Spool) Write(payload string, isMetric bool, headers map[string]string) (uint64, error) {
+	value, err := json.Marshal(&Batch{Created: time.Now(), IsMetric: isMetric, Payload: payload, Headers: headers})
+	if err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var id uint64
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(batchesBucket)
+		if s.maxBytes > 0 {
+			c := b.Cursor()
+			for k, v := c.First(); k != nil && s.bytes+int64(len(value)) > s.maxBytes; k, v = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				s.removed(decodeID(k), len(v))
+				s.dropped++
+			}
+		}
+		id, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(encodeID(id), value)
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.count++
+	s.bytes += int64(len(value))
+	s.inFlight[id] = true
+	return id, nil
+}
+
+// Next checks out the oldest batch that is not being delivered, or returns nil
+// when there is none. Expired batches are dropped on the way.
+func (s *Spool) Next() (*Batch, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var batch *Batch
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(batchesBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			id := decodeID(k)
+			if s.inFlight[id] {
+				continue
+			}
+			candidate := &Batch{}
+			if err := json.Unmarshal(v, candidate); err != nil || (s.maxAge > 0 && time.Since(candidate.Created) > s.maxAge) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				s.removed(id, len(v))
+				s.dropped++
+				continue
+			}
+			candidate.ID = id
+			batch = candidate
+			return nil
+		}
+		return nil
+	})
+	if err != nil || batch == nil {
+		return nil, err
+	}
+	s.inFlight[batch.ID] = true
+	return batch, nil
+}
+
+// Done returns a checked out batch, removing it from the spool when it is
+// settled: delivered, or rejected for good by the endpoint.
+func (s *Spool) Done(id uint64, settled bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.inFlight, id)
+	if !settled {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(batchesBucket)
+		v := b.Get(encodeID(id))
+		if v == nil {
+			return nil
+		}
+		s.removed(id, len(v))
+		return b.Delete(encodeID(id))
+	})
+}
+
+// Size returns the number of batches in the spool and their size in bytes.
+func (s *Spool) Size() (int, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count, s.bytes
+}
+
+// Dropped returns the number of batches dropped because the spool was full or
+// they expired.
+func (s *Spool) Dropped() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dropped
+}
+
+func (s *Spool) Close() error {
+	return s.db.Close()
+}
+
+func (s *Spool) removed(id uint64, size int) {
+	delete(s.inFlight, id)
+	s.count--
+	s.bytes -= int64(size)
+}
+
+// encodeID encodes ids big endian so that bolt iterates them in write order.
+func encodeID(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+func decodeID(k []byte) uint64 {
+	return binary.BigEndian.Uint64(k)
+}
@@ -0,0 +1,110 @@
+package spool
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openSpool(t *testing.T, maxBytes int64, maxAge time.Duration) (*Spool, string) {
+	path := filepath.Join(t.TempDir(), "spool.db")
+	s, err := Open(path, maxBytes, maxAge)
+	assert.NoError(t, err)
+	return s, path
+}
+
+func TestWrittenBatchIsCheckedOut(t *testing.T) {
+	s, _ := openSpool(t, 0, 0)
+	defer s.Close()
+
+	id, err := s.Write("line 1\n", false, nil)
+	assert.NoError(t, err)
+
+	batch, err := s.Next()
+	assert.NoError(t, err)
+	assert.Nil(t, batch, "a batch being delivered is not replayed")
+
+	assert.NoError(t, s.Done(id, true))
+	batches, bytes := s.Size()
+	assert.Equal(t, 0, batches)
+	assert.Equal(t, int64(0), bytes)
+}
+
+func TestFailedBatchesAreReplayedInOrder(t *testing.T) {
+	s, _ := openSpool(t, 0, 0)
+	defer s.Close()
+
+	first, _ := s.Write("first\n", false, nil)
+	second, _ := s.Write("metric=second  1 2\n", true, map[string]string{"X-Sumo-Category": "cf/org"})
+	s.Done(second, false)
+	s.Done(first, false)
+
+	batch, err := s.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "first\n", batch.Payload)
+	assert.False(t, batch.IsMetric)
+
+	batch, _ = s.Next()
+	assert.Equal(t, "metric=second  1 2\n", batch.Payload)
+	assert.True(t, batch.IsMetric)
+	assert.Equal(t, "cf/org", batch.Headers["X-Sumo-Category"])
+
+	batch, _ = s.Next()
+	assert.Nil(t, batch)
+}
+
+func TestBatchesSurviveReopening(t *testing.T) {
+	s, path := openSpool(t, 0, 0)
+	s.Write("in flight when stopped\n", false, nil)
+	s.Close()
+
+	s, err := Open(path, 0, 0)
+	assert.NoError(t, err)
+	defer s.Close()
+	batches, _ := s.Size()
+	assert.Equal(t, 1, batches)
+
+	batch, _ := s.Next()
+	assert.Equal(t, "in flight when stopped\n", batch.Payload)
+}
+
+func TestOldestBatchesAreDroppedWhenFull(t *testing.T) {
+	s, _ := openSpool(t, 200, 0)
+	defer s.Close()
+
+	for _, payload := range []string{"one", "two", "three"} {
+		id, _ := s.Write(payload, false, nil)
+		s.Done(id, false)
+	}
+
+	batches, bytes := s.Size()
+	assert.Equal(t, 2, batches)
+	assert.True(t, bytes <= 200)
+	assert.Equal(t, uint64(1), s.Dropped())
+	batch, _ := s.Next()
+	assert.Equal(t, "two", batch.Payload)
+}
+
+func TestExpiredBatchesAreDropped(t *testing.T) {
+	s, _ := openSpool(t, 0, 10*time.Millisecond)
+	defer s.Close()
+
+	id, _ := s.Write("expired", false, nil)
+	s.Done(id, false)
+	time.Sleep(20 * time.Millisecond)
+
+	batch, err := s.Next()
+	assert.NoError(t, err)
+	assert.Nil(t, batch)
+	assert.Equal(t, uint64(1), s.Dropped())
+}
+
+func TestPathHidesTheEndpoint(t *testing.T) {
+	path := Path("/var/spool", "https://collectors.sumologic.com/receiver/v1/http/SECRET")
+
+	assert.Equal(t, "/var/spool", filepath.Dir(path))
+	assert.NotContains(t, path, "SECRET")
+	assert.Equal(t, path, Path("/var/spool", "https://collectors.sumologic.com/receiver/v1/http/SECRET"))
+}
@@ -0,0 +1,98 @@
+package sumoCFFirehose
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+)
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitProbeWait is how long posts wait while a half-open circuit probes the
+// endpoint.
+const circuitProbeWait = time.Second
+
+// circuitBreaker stops posting to an endpoint after consecutive failures. Once
+// openPeriod elapsed, it lets one post probe the endpoint (half-open), and
+// closes again if it succeeds.
+type circuitBreaker struct {
+	mutex      *sync.Mutex
+	name       string
+	state      CircuitState
+	failures   int
+	threshold  int
+	openPeriod time.Duration
+	openedAt   time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, openPeriod time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		mutex:      &sync.Mutex{},
+		name:       name,
+		threshold:  threshold,
+		openPeriod: openPeriod,
+	}
+}
+
+// allow tells whether a post can be made now, or how long to wait before
+// asking again.
+func (b *circuitBreaker) allow(now time.Time) (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if wait := b.openedAt.Add(b.openPeriod).Sub(now); wait > 0 {
+			return false, wait
+		}
+		b.state = CircuitHalfOpen
+		logging.Info.Printf("Circuit breaker of %s half-open, probing the endpoint", b.name)
+		return true, 0
+	case CircuitHalfOpen:
+		return false, circuitProbeWait
+	}
+	return true, 0
+}
+
+// record updates the circuit with the outcome of a post, failed meaning that
+// the endpoint could not take it.
+func (b *circuitBreaker) record(failed bool, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !failed {
+		if b.state != CircuitClosed {
+			logging.Info.Printf("Circuit breaker of %s closed, the endpoint recovered", b.name)
+		}
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || (b.state == CircuitClosed && b.threshold > 0 && b.failures >= b.threshold) {
+		logging.Warning.Printf("Circuit breaker of %s open after %d consecutive failures, pausing posts for %v", b.name, b.failures, b.openPeriod)
+		b.state = CircuitOpen
+		b.openedAt = now
+	}
+}
+
+func (b *circuitBreaker) getState() CircuitState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
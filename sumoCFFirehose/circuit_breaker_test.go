@@ -0,0 +1,56 @@
+package sumoCFFirehose
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	breaker := newCircuitBreaker("endpoint 0", 3, time.Minute)
+	now := time.Now()
+
+	breaker.record(true, now)
+	breaker.record(true, now)
+	breaker.record(false, now)
+	breaker.record(true, now)
+	breaker.record(true, now)
+	assert.Equal(t, CircuitClosed, breaker.getState(), "a success resets the failures")
+
+	breaker.record(true, now)
+	assert.Equal(t, CircuitOpen, breaker.getState())
+	allowed, wait := breaker.allow(now.Add(20 * time.Second))
+	assert.False(t, allowed)
+	assert.Equal(t, 40*time.Second, wait)
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	breaker := newCircuitBreaker("endpoint 0", 1, time.Minute)
+	now := time.Now()
+	breaker.record(true, now)
+
+	allowed, _ := breaker.allow(now.Add(time.Minute))
+	assert.True(t, allowed, "one post probes the endpoint")
+	assert.Equal(t, CircuitHalfOpen, breaker.getState())
+	allowed, wait := breaker.allow(now.Add(time.Minute))
+	assert.False(t, allowed, "other posts wait for the probe")
+	assert.Equal(t, circuitProbeWait, wait)
+
+	breaker.record(true, now.Add(time.Minute))
+	assert.Equal(t, CircuitOpen, breaker.getState(), "a failed probe opens the circuit again")
+
+	breaker.allow(now.Add(2 * time.Minute))
+	breaker.record(false, now.Add(2*time.Minute))
+	assert.Equal(t, CircuitClosed, breaker.getState())
+	allowed, _ = breaker.allow(now.Add(2 * time.Minute))
+	assert.True(t, allowed)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	breaker := newCircuitBreaker("endpoint 0", 0, time.Minute)
+	for i := 0; i < 100; i++ {
+		breaker.record(true, time.Now())
+	}
+	assert.Equal(t, CircuitClosed, breaker.getState())
+}
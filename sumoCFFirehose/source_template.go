@@ -0,0 +1,118 @@
+package sumoCFFirehose
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+)
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([\w.-]+)\s*\}\}`)
+
+// sourceTemplate renders an X-Sumo-Category, X-Sumo-Name or X-Sumo-Host from
+// the fields of an event, e.g. cf/{{cf_org_name}}/{{cf_space_name}}. Missing
+// fields are rendered as empty strings.
+type sourceTemplate struct {
+	literals []string
+	fields   []string
+}
+
+func parseSourceTemplate(template string) *sourceTemplate {
+	t := &sourceTemplate{}
+	last := 0
+	for _, match := range placeholderPattern.FindAllStringSubmatchIndex(template, -1) {
+		t.literals = append(t.literals, template[last:match[0]])
+		t.fields = append(t.fields, template[match[2]:match[3]])
+		last = match[1]
+	}
+	t.literals = append(t.literals, template[last:])
+	return t
+}
+
+func (t *sourceTemplate) render(event *events.Event) string {
+	if len(t.fields) == 0 {
+		return t.literals[0]
+	}
+	var rendered strings.Builder
+	for i, field := range t.fields {
+		rendered.WriteString(t.literals[i])
+		if value, found := event.Fields[field]; found && value != nil {
+			rendered.WriteString(headerValue(fmt.Sprint(value)))
+		}
+	}
+	rendered.WriteString(t.literals[len(t.fields)])
+	return rendered.String()
+}
+
+// headerValue removes the line breaks that would end the header early.
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// sumoField is a field sent in the X-Sumo-Fields header, whose value can be a
+// template.
+type sumoField struct {
+	key   string
+	value *sourceTemplate
+}
+
+// parseSumoFields parses fields formatted as key1:value1,key2:{{field}}, the
+// format of the custom metadata.
+func parseSumoFields(fields string) ([]sumoField, error) {
+	result := []sumoField{}
+	if strings.TrimSpace(fields) == "" {
+		return result, nil
+	}
+	for _, entry := range strings.Split(fields, ",") {
+		keyValue := strings.SplitN(entry, ":", 2)
+		key := strings.TrimSpace(keyValue[0])
+		if len(keyValue) != 2 || key == "" || strings.ContainsAny(key, "=\r\n") {
+			return nil, fmt.Errorf("invalid field %q, expected key:value", entry)
+		}
+		result = append(result, sumoField{key: key, value: parseSourceTemplate(strings.TrimSpace(keyValue[1]))})
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].key < result[j].key })
+	return result, nil
+}
+
+// renderSumoFields renders the X-Sumo-Fields header of an event, leaving out
+// the fields with an empty value.
+func renderSumoFields(fields []sumoField, event *events.Event) string {
+	rendered := make([]string, 0, len(fields))
+	for _, field := range fields {
+		value := strings.NewReplacer(",", "", "=", "").Replace(field.value.render(event))
+		if value != "" {
+			rendered = append(rendered, field.key+"="+value)
+		}
+	}
+	return strings.Join(rendered, ",")
+}
+
+// sourceHeaders are the source metadata of a post, batches only hold events
+// sharing the same ones.
+type sourceHeaders struct {
+	category string
+	name     string
+	host     string
+	fields   string
+}
+
+func (h sourceHeaders) toMap() map[string]string {
+	return map[string]string{
+		"X-Sumo-Category": h.category,
+		"X-Sumo-Name":     h.name,
+		"X-Sumo-Host":     h.host,
+		"X-Sumo-Fields":   h.fields,
+	}
+}
+
+func sourceHeadersFromMap(headers map[string]string) sourceHeaders {
+	return sourceHeaders{
+		category: headers["X-Sumo-Category"],
+		name:     headers["X-Sumo-Name"],
+		host:     headers["X-Sumo-Host"],
+		fields:   headers["X-Sumo-Fields"],
+	}
+}
@@ -0,0 +1,39 @@
+package sumoCFFirehose
+
+import (
+	"testing"
+
+	. "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceTemplateRendersEventFields(t *testing.T) {
+	event := &Event{Fields: map[string]interface{}{
+		"cf_org_name":    "system",
+		"cf_space_name":  "dev",
+		"cf_app_name":    "web\r\nX-Injected: 1",
+		"instance_index": 2,
+	}}
+
+	assert.Equal(t, "cf/system/dev/webX-Injected: 1", parseSourceTemplate("cf/{{cf_org_name}}/{{ cf_space_name }}/{{cf_app_name}}").render(event))
+	assert.Equal(t, "instance-2", parseSourceTemplate("instance-{{instance_index}}").render(event))
+	assert.Equal(t, "cf//logs", parseSourceTemplate("cf/{{job}}/logs").render(event), "missing fields are empty")
+	assert.Equal(t, "static", parseSourceTemplate("static").render(event))
+	assert.Equal(t, "", parseSourceTemplate("").render(event))
+}
+
+func TestParseSumoFields(t *testing.T) {
+	fields, err := parseSumoFields("environment:prod, org:{{cf_org_name}},app:{{cf_app_name}}")
+	assert.NoError(t, err)
+	event := &Event{Fields: map[string]interface{}{"cf_org_name": "system,dev=1"}}
+	assert.Equal(t, "environment=prod,org=systemdev1", renderSumoFields(fields, event), "empty fields are left out")
+
+	fields, err = parseSumoFields("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", renderSumoFields(fields, event))
+
+	_, err = parseSumoFields("environment")
+	assert.Error(t, err)
+	_, err = parseSumoFields(":prod")
+	assert.Error(t, err)
+}
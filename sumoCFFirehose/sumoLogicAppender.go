@@ -4,124 +4,463 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventQueue"
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/filter"
 	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/spool"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/utils"
 )
 
+// queueSizeLogPeriod is how often the appender logs the size of its queue.
+const queueSizeLogPeriod = 10 * time.Second
+
+// retryMinDelay and retryMaxDelay bound the backoff between the retries of a
+// post, unless the endpoint asks for a longer delay with Retry-After.
+const (
+	retryMinDelay = 500 * time.Millisecond
+	retryMaxDelay = 30 * time.Second
+)
+
+// Defaults of the sender pool and of the circuit breaker, see SetupSenders.
+const (
+	defaultMaxConcurrentPosts = 4
+	defaultCircuitFailures    = 5
+	defaultCircuitOpenPeriod  = 30 * time.Second
+)
+
+// defaultMaxBatchBytes keeps the uncompressed posts under the 1 MB limit of the
+// Sumo Logic HTTP sources.
+const defaultMaxBatchBytes = 1000000
+
+// truncationMargin is removed from the messages in excess, to leave room for
+// the truncated field.
+const truncationMargin = 32
+
 type SumoLogicAppender struct {
 	url                         string
 	connectionTimeout           int //10000
 	httpClient                  http.Client
 	nozzleQueue                 *eventQueue.Queue
 	eventsBatchSize             int
+	maxBatchBytes               int
 	sumoPostMinimumDelay        time.Duration
+	sumoFlushInterval           time.Duration
+	sumoMaxRetryDuration        time.Duration
+	retryMinDelay               time.Duration
+	retryMaxDelay               time.Duration
 	timerBetweenPost            time.Time
-	sumoCategory                string
-	sumoName                    string
-	sumoHost                    string
+	postMutex                   *sync.Mutex
+	senders                     chan struct{}
+	breaker                     *circuitBreaker
+	sumoCategory                *sourceTemplate
+	sumoName                    *sourceTemplate
+	sumoHost                    *sourceTemplate
+	sumoFields                  []sumoField
 	verboseLogMessages          bool
 	customMetadata              string
 	includeOnlyMatchingFilter   string
 	excludeAlwaysMatchingFilter string
+	eventFilter                 *filter.Expression
 	nozzleVersion               string
 	logDelay                    time.Time
+	stats                       AppenderStats
+	running                     int32
+	lastPostSent                int64
+	failingSince                int64
+	spool                       *spool.Spool
+	stop                        chan struct{}
+	stopOnce                    *sync.Once
+	stopped                     chan struct{}
+	replaying                   *sync.WaitGroup
 }
 
+// AppenderStats counts the posts made to the Sumo Logic endpoint.
+type AppenderStats struct {
+	PostsSent    uint64
+	PostsFailed  uint64
+	PostsRetried uint64
+	BytesSent    uint64
+}
+
+// SumoBuffer holds the events of a batch, grouped by the source headers they
+// are posted with.
 type SumoBuffer struct {
 	eventsInCurrentBuffer int
-	logStringToSend       *bytes.Buffer
-	metricStringToSend    *bytes.Buffer
-	timerIdlebuffer       time.Time
+	sources               map[sourceHeaders]*sourceBatch
+	firstEventTime        time.Time
+}
+
+type sourceBatch struct {
+	logStringToSend    *bytes.Buffer
+	metricStringToSend *bytes.Buffer
 }
 
-func NewSumoLogicAppender(urlValue string, connectionTimeoutValue int, nozzleQueue *eventQueue.Queue, eventsBatchSize int, sumoPostMinimumDelay time.Duration, sumoCategory string, sumoName string, sumoHost string, verboseLogMessages bool, customMetadata string, includeOnlyMatchingFilter string, excludeAlwaysMatchingFilter string, nozzleVersion string) *SumoLogicAppender {
+func (b *SumoBuffer) source(headers sourceHeaders) *sourceBatch {
+	batch, found := b.sources[headers]
+	if !found {
+		batch = &sourceBatch{
+			logStringToSend:    bytes.NewBufferString(""),
+			metricStringToSend: bytes.NewBufferString(""),
+		}
+		b.sources[headers] = batch
+	}
+	return batch
+}
+
+func NewSumoLogicAppender(urlValue string, connectionTimeoutValue int, nozzleQueue *eventQueue.Queue, eventsBatchSize int, sumoPostMinimumDelay time.Duration, sumoFlushInterval time.Duration, sumoMaxRetryDuration time.Duration, sumoCategory string, sumoName string, sumoHost string, verboseLogMessages bool, customMetadata string, includeOnlyMatchingFilter string, excludeAlwaysMatchingFilter string, nozzleVersion string) *SumoLogicAppender {
 	return &SumoLogicAppender{
 		url:                         urlValue,
 		connectionTimeout:           connectionTimeoutValue,
 		httpClient:                  http.Client{Timeout: time.Duration(connectionTimeoutValue * int(time.Millisecond))},
 		nozzleQueue:                 nozzleQueue,
 		eventsBatchSize:             eventsBatchSize,
+		maxBatchBytes:               defaultMaxBatchBytes,
 		sumoPostMinimumDelay:        sumoPostMinimumDelay,
-		sumoCategory:                sumoCategory,
-		sumoName:                    sumoName,
-		sumoHost:                    sumoHost,
+		sumoFlushInterval:           sumoFlushInterval,
+		sumoMaxRetryDuration:        sumoMaxRetryDuration,
+		retryMinDelay:               retryMinDelay,
+		retryMaxDelay:               retryMaxDelay,
+		timerBetweenPost:            time.Now(),
+		postMutex:                   &sync.Mutex{},
+		senders:                     make(chan struct{}, defaultMaxConcurrentPosts),
+		breaker:                     newCircuitBreaker("endpoint", defaultCircuitFailures, defaultCircuitOpenPeriod),
+		sumoCategory:                parseSourceTemplate(sumoCategory),
+		sumoName:                    parseSourceTemplate(sumoName),
+		sumoHost:                    parseSourceTemplate(sumoHost),
 		verboseLogMessages:          verboseLogMessages,
 		customMetadata:              customMetadata,
 		includeOnlyMatchingFilter:   includeOnlyMatchingFilter,
 		excludeAlwaysMatchingFilter: excludeAlwaysMatchingFilter,
 		nozzleVersion:               nozzleVersion,
+		stop:                        make(chan struct{}),
+		stopOnce:                    &sync.Once{},
+		stopped:                     make(chan struct{}),
+		replaying:                   &sync.WaitGroup{},
+	}
+}
+
+// Stats returns a snapshot of the post counters of the appender.
+func (s *SumoLogicAppender) Stats() AppenderStats {
+	return AppenderStats{
+		PostsSent:    atomic.LoadUint64(&s.stats.PostsSent),
+		PostsFailed:  atomic.LoadUint64(&s.stats.PostsFailed),
+		PostsRetried: atomic.LoadUint64(&s.stats.PostsRetried),
+		BytesSent:    atomic.LoadUint64(&s.stats.BytesSent),
+	}
+}
+
+// SetupSenders bounds the number of posts in flight to the endpoint, named
+// in the logs, and opens its circuit breaker for openPeriod after
+// failureThreshold consecutive failed posts. It must be called before Start.
+func (s *SumoLogicAppender) SetupSenders(name string, maxConcurrentPosts int, failureThreshold int, openPeriod time.Duration) {
+	if maxConcurrentPosts < 1 {
+		maxConcurrentPosts = 1
+	}
+	s.senders = make(chan struct{}, maxConcurrentPosts)
+	s.breaker = newCircuitBreaker(name, failureThreshold, openPeriod)
+}
+
+// SetupMaxBatchBytes sets the maximum uncompressed size of the posts of logs
+// and of metrics. It must be called before Start.
+func (s *SumoLogicAppender) SetupMaxBatchBytes(maxBatchBytes int) {
+	if maxBatchBytes > 0 {
+		s.maxBatchBytes = maxBatchBytes
+	}
+}
+
+// ValidateFields checks the format of the fields sent in the X-Sumo-Fields
+// header, key1:value1,key2:{{field}}.
+func ValidateFields(fields string) error {
+	_, err := parseSumoFields(fields)
+	return err
+}
+
+// SetupFields sends fields, formatted as key1:value1,key2:{{field}}, in the
+// X-Sumo-Fields header. Batches are split by rendered set of fields. It must be
+// called before Start.
+func (s *SumoLogicAppender) SetupFields(fields string) error {
+	parsed, err := parseSumoFields(fields)
+	if err != nil {
+		return err
+	}
+	s.sumoFields = parsed
+	return nil
+}
+
+// SetupFilter only sends the events matching a filter expression, evaluated
+// against the event fields before the include and exclude filters. It must be
+// called before Start.
+func (s *SumoLogicAppender) SetupFilter(expression string) error {
+	parsed, err := filter.Parse(expression)
+	if err != nil {
+		return err
+	}
+	s.eventFilter = parsed
+	return nil
+}
+
+// InFlightPosts returns the number of batches being posted.
+func (s *SumoLogicAppender) InFlightPosts() int {
+	return len(s.senders)
+}
+
+// CircuitState returns the state of the circuit breaker of the endpoint.
+func (s *SumoLogicAppender) CircuitState() CircuitState {
+	return s.breaker.getState()
+}
+
+// QueueSize returns the number of events waiting to be appended to a batch.
+func (s *SumoLogicAppender) QueueSize() int {
+	return s.nozzleQueue.GetCount()
+}
+
+// QueueDropped returns the number of events dropped because the queue was full.
+func (s *SumoLogicAppender) QueueDropped() uint64 {
+	return s.nozzleQueue.GetDropped()
+}
+
+// Running reports whether the appender worker loop is running.
+func (s *SumoLogicAppender) Running() bool {
+	return atomic.LoadInt32(&s.running) == 1
+}
+
+// LastPostSent returns the time of the last successful post, or the zero time
+// when nothing was posted yet.
+func (s *SumoLogicAppender) LastPostSent() time.Time {
+	lastPostSent := atomic.LoadInt64(&s.lastPostSent)
+	if lastPostSent == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastPostSent)
+}
+
+// FailingSince returns the time of the first failed post since the last
+// successful one, or the zero time when the last post was successful.
+func (s *SumoLogicAppender) FailingSince() time.Time {
+	failingSince := atomic.LoadInt64(&s.failingSince)
+	if failingSince == 0 {
+		return time.Time{}
 	}
+	return time.Unix(0, failingSince)
+}
+
+func (s *SumoLogicAppender) postFailed() {
+	atomic.CompareAndSwapInt64(&s.failingSince, 0, time.Now().UnixNano())
+}
+
+func (s *SumoLogicAppender) postSent(logStringToSend string) {
+	atomic.StoreInt64(&s.failingSince, 0)
+	atomic.StoreInt64(&s.lastPostSent, time.Now().UnixNano())
+	atomic.AddUint64(&s.stats.PostsSent, 1)
+	atomic.AddUint64(&s.stats.BytesSent, uint64(len(logStringToSend)))
 }
 
 func newBuffer() SumoBuffer {
 	return SumoBuffer{
 		eventsInCurrentBuffer: 0,
-		logStringToSend:       bytes.NewBufferString(""),
-		metricStringToSend:    bytes.NewBufferString(""),
+		sources:               make(map[sourceHeaders]*sourceBatch),
+	}
+}
+
+// flush sends the logs and the metrics of every source of the buffer.
+func (s *SumoLogicAppender) flush(buffer *SumoBuffer) {
+	for headers, batch := range buffer.sources {
+		s.dispatch(batch.logStringToSend.String(), false, headers)
+		s.dispatch(batch.metricStringToSend.String(), true, headers)
 	}
 }
 
+// sourceHeaders renders the category, name and host templates for an event.
+func (s *SumoLogicAppender) sourceHeaders(event *events.Event) sourceHeaders {
+	return sourceHeaders{
+		category: s.sumoCategory.render(event),
+		name:     s.sumoName.render(event),
+		host:     s.sumoHost.render(event),
+		fields:   renderSumoFields(s.sumoFields, event),
+	}
+}
+
+// Start appends the queued events to a batch, which is sent when it holds
+// eventsBatchSize lines or when its first event waited for the flush interval.
+// It returns once the appender is drained.
 func (s *SumoLogicAppender) Start() {
-	s.timerBetweenPost = time.Now()
 	Buffer := newBuffer()
-	Buffer.timerIdlebuffer = time.Now()
 	s.logDelay = time.Now()
 	logging.Info.Println("Starting Appender Worker")
+	atomic.StoreInt32(&s.running, 1)
+	defer close(s.stopped)
+	defer atomic.StoreInt32(&s.running, 0)
 	for {
-		if time.Since(s.logDelay).Seconds() >= 10 {
+		if time.Since(s.logDelay) >= queueSizeLogPeriod {
 			logging.Info.Printf("Log queue size: %d", s.nozzleQueue.GetCount())
+			if dropped := s.nozzleQueue.GetDropped(); dropped > 0 {
+				logging.Warning.Printf("Log queue full, %d events dropped since start", dropped)
+			}
 			s.logDelay = time.Now()
 		}
 
-		if s.nozzleQueue.GetCount() == 0 {
-			logging.Trace.Println("Waiting for 300 ms")
-			time.Sleep(300 * time.Millisecond)
+		deadline := s.logDelay.Add(queueSizeLogPeriod)
+		if Buffer.eventsInCurrentBuffer > 0 && Buffer.firstEventTime.Add(s.sumoFlushInterval).Before(deadline) {
+			deadline = Buffer.firstEventTime.Add(s.sumoFlushInterval)
+		}
+		event := s.nozzleQueue.PopWait(deadline)
+		if event == nil && s.draining() {
+			logging.Info.Println("Draining Appender Worker... #of Events: ", Buffer.eventsInCurrentBuffer)
+			s.flush(&Buffer)
+			s.waitForSenders()
+			return
 		}
 
-		if time.Since(Buffer.timerIdlebuffer).Seconds() >= 10 && Buffer.eventsInCurrentBuffer > 0 {
+		if event != nil {
+			if Buffer.eventsInCurrentBuffer == 0 {
+				Buffer.firstEventTime = time.Now()
+			}
+			s.appendEvent(&Buffer, event)
+			if Buffer.eventsInCurrentBuffer < s.eventsBatchSize {
+				continue
+			}
+			logging.Trace.Println("Pushing Logs to Sumo: ", Buffer.eventsInCurrentBuffer)
+		} else if Buffer.eventsInCurrentBuffer == 0 || time.Since(Buffer.firstEventTime) < s.sumoFlushInterval {
+			continue
+		} else {
 			logging.Info.Println("Sending batch after timer exceeded... #of Events: ", Buffer.eventsInCurrentBuffer)
+		}
 
-			go s.SendToSumo(Buffer.logStringToSend.String(), s.url, false)
-			go s.SendToSumo(Buffer.metricStringToSend.String(), s.url, true)
+		s.flush(&Buffer)
+		Buffer = newBuffer()
+	}
+}
 
-			Buffer = newBuffer()
-			Buffer.timerIdlebuffer = time.Now()
-			continue
-		}
+// Drain stops the appender once the events left in its queue are sent, and
+// waits for the posts in flight and for the spool replay. Start must have been
+// called, and no event must be pushed to the queue afterwards.
+func (s *SumoLogicAppender) Drain() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.nozzleQueue.Close()
+	<-s.stopped
+	s.replaying.Wait()
+}
 
-		if s.nozzleQueue.GetCount() != 0 {
-			queueCount := s.nozzleQueue.GetCount()
-			remainingBufferCount := s.eventsBatchSize - Buffer.eventsInCurrentBuffer
-			if queueCount >= remainingBufferCount {
-				logging.Trace.Println("Pushing Logs to Sumo: ")
-				logging.Trace.Println(remainingBufferCount)
-				for i := 0; i < remainingBufferCount; i++ {
-					s.AppendLogs(&Buffer)
-					Buffer.timerIdlebuffer = time.Now()
-				}
+func (s *SumoLogicAppender) draining() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
 
-				go s.SendToSumo(Buffer.logStringToSend.String(), s.url, false)
-				go s.SendToSumo(Buffer.metricStringToSend.String(), s.url, true)
+// waitForSenders waits until no batch is being posted, by taking every sender.
+func (s *SumoLogicAppender) waitForSenders() {
+	for i := 0; i < cap(s.senders); i++ {
+		s.senders <- struct{}{}
+	}
+	for i := 0; i < cap(s.senders); i++ {
+		<-s.senders
+	}
+}
 
-				Buffer = newBuffer()
-			} else {
-				logging.Trace.Println("Pushing Logs to Buffer: ")
-				logging.Trace.Println(queueCount)
-				for i := 0; i < queueCount; i++ {
-					s.AppendLogs(&Buffer)
-					Buffer.timerIdlebuffer = time.Now()
-				}
-			}
+// SetupSpool keeps the batches in sp until they are delivered, and replays the
+// ones left by a previous run or by exhausted retries, waiting retryPeriod
+// after a failed replay.
+func (s *SumoLogicAppender) SetupSpool(sp *spool.Spool, retryPeriod time.Duration) {
+	s.spool = sp
+	batches, bytes := sp.Size()
+	if batches > 0 {
+		logging.Info.Printf("Replaying %d spooled batches (%d bytes)", batches, bytes)
+	}
+	s.replaying.Add(1)
+	go s.replaySpool(retryPeriod)
+}
+
+// SpoolStats returns the number of batches in the spool, their size in bytes
+// and the number of batches dropped because the spool was full or they expired.
+func (s *SumoLogicAppender) SpoolStats() (int, int64, uint64) {
+	if s.spool == nil {
+		return 0, 0, 0
+	}
+	batches, bytes := s.spool.Size()
+	return batches, bytes, s.spool.Dropped()
+}
+
+// dispatch hands a batch to the sender pool, waiting for a free sender when
+// the maximum number of posts are in flight.
+func (s *SumoLogicAppender) dispatch(payload string, isMetric bool, headers sourceHeaders) {
+	if payload == "" {
+		return
+	}
+	s.senders <- struct{}{}
+	go func() {
+		defer func() { <-s.senders }()
+		s.deliver(payload, isMetric, headers)
+	}()
+}
+
+// deliver posts a batch, keeping it in the spool until it is delivered.
+func (s *SumoLogicAppender) deliver(payload string, isMetric bool, headers sourceHeaders) {
+	if s.spool == nil || payload == "" {
+		s.send(payload, s.url, isMetric, headers)
+		return
+	}
+	id, err := s.spool.Write(payload, isMetric, headers.toMap())
+	if err != nil {
+		logging.Error.Printf("Error writing batch to the spool: %v", err)
+		s.send(payload, s.url, isMetric, headers)
+		return
+	}
+	outcome := s.send(payload, s.url, isMetric, headers)
+	if err := s.spool.Done(id, outcome != postRetryable); err != nil {
+		logging.Error.Printf("Error updating the spool: %v", err)
+	}
+}
+
+func (s *SumoLogicAppender) replaySpool(retryPeriod time.Duration) {
+	defer s.replaying.Done()
+	for !s.draining() {
+		batch, err := s.spool.Next()
+		if err != nil {
+			logging.Error.Printf("Error reading the spool: %v", err)
 		}
+		if batch == nil {
+			s.sleepUnlessDraining(retryPeriod)
+			continue
+		}
+		logging.Trace.Printf("Replaying spooled batch %d from %v", batch.ID, batch.Created)
+		s.senders <- struct{}{}
+		outcome := s.send(batch.Payload, s.url, batch.IsMetric, sourceHeadersFromMap(batch.Headers))
+		<-s.senders
+		if err := s.spool.Done(batch.ID, outcome != postRetryable); err != nil {
+			logging.Error.Printf("Error updating the spool: %v", err)
+		}
+		if outcome == postRetryable {
+			s.sleepUnlessDraining(retryPeriod)
+		}
+	}
+}
+
+// sleepUnlessDraining waits for delay, or until the appender is drained, and
+// reports whether the whole delay elapsed.
+func (s *SumoLogicAppender) sleepUnlessDraining(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stop:
+		return false
 	}
 }
 
@@ -177,7 +516,7 @@ func FormatTimestamp(event *events.Event, timestamp string) {
 		event.Fields[timestamp] = event.Fields[timestamp].(string)
 	} else if reflect.TypeOf(event.Fields[timestamp]).Kind() == reflect.Int64 {
 		if len(strconv.FormatInt(event.Fields[timestamp].(int64), 10)) == 19 {
-			if event.Type == "ValueMetric" || event.Type == "CounterEvent" || event.Type == "ContainerMetric" {
+			if events.IsMetric(event.Type) {
 				event.Fields[timestamp] = event.Fields[timestamp].(int64) / int64(time.Second)
 			} else {
 				event.Fields[timestamp] = time.Unix(0, event.Fields[timestamp].(int64)*int64(time.Nanosecond)).String()
@@ -188,6 +527,33 @@ func FormatTimestamp(event *events.Event, timestamp string) {
 	}
 }
 
+// carbon2Intrinsics renders the deployment, job and origin tags that start
+// every carbon2 metric line.
+func carbon2Intrinsics(event *events.Event) string {
+	ip := ""
+	if ipString := event.Fields["ip"]; ipString != nil && ipString != "" {
+		ip = fmt.Sprintf(" ip=%s", ipString)
+	}
+	origin := processEmptyMetricField(fmt.Sprintf("%v", event.Fields["origin"]), "unknown")
+	return fmt.Sprintf("deployment=%s job_index=%s%s job=%s origin=%s",
+		event.Fields["deployment"], event.Fields["job_index"], ip, event.Fields["job"], origin)
+}
+
+// carbon2Metadata renders the event tags as carbon2 metadata, sorted by name.
+// Spaces are not allowed in carbon2 values and are replaced by underscores.
+func carbon2Metadata(tags map[string]string) string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metadata := make([]string, 0, len(names))
+	for _, name := range names {
+		metadata = append(metadata, name+"="+strings.Replace(tags[name], " ", "_", -1))
+	}
+	return strings.Join(metadata, " ")
+}
+
 func StringBuilder(event *events.Event, verboseLogMessages bool, includeOnlyMatchingFilter string, excludeAlwaysMatchingFilter string, customMetadata string) string {
 	if customMetadata != "" {
 		customMetadataMap := ParseCustomInput(customMetadata)
@@ -205,6 +571,12 @@ func StringBuilder(event *events.Event, verboseLogMessages bool, includeOnlyMatc
 		if err == nil {
 			msg = message
 		}
+	case "HttpStart", "HttpStop":
+		FormatTimestamp(event, "timestamp")
+		message, err := json.Marshal(event)
+		if err == nil {
+			msg = message
+		}
 	case "LogMessage":
 		FormatTimestamp(event, "timestamp")
 		if verboseLogMessages == true {
@@ -226,6 +598,12 @@ func StringBuilder(event *events.Event, verboseLogMessages bool, includeOnlyMatc
 				Msg:  event.Msg,
 				Type: event.Type,
 			}
+			if truncated, found := event.Fields["truncated"]; found {
+				eventNoVerbose.Fields["truncated"] = truncated
+			}
+			for key, value := range event.Tags {
+				eventNoVerbose.Fields[key] = value
+			}
 			if customMetadata != "" {
 				customMetadataMap := ParseCustomInput(customMetadata)
 				for key, value := range customMetadataMap {
@@ -306,12 +684,46 @@ func StringBuilder(event *events.Event, verboseLogMessages bool, includeOnlyMatc
 			deployment, jobIndex, ip, job, origin, cfOrgName, cfOrgId, cfSpaceName, cfSpaceId, cfAppName, cfAppId, instanceIndex, event.Fields["disk_bytes_quota"], timestamp,
 			deployment, jobIndex, ip, job, origin, cfOrgName, cfOrgId, cfSpaceName, cfSpaceId, cfAppName, cfAppId, instanceIndex, event.Fields["memory_bytes"], timestamp,
 			deployment, jobIndex, ip, job, origin, cfOrgName, cfOrgId, cfSpaceName, cfSpaceId, cfAppName, cfAppId, instanceIndex, event.Fields["memory_bytes_quota"], timestamp))
+	case "Gauge":
+		FormatTimestamp(event, "timestamp")
+		gaugeMetrics, _ := event.Fields["metrics"].(map[string]events.GaugeValueV2)
+		names := make([]string, 0, len(gaugeMetrics))
+		for name := range gaugeMetrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		lines := make([]string, 0, len(names))
+		for _, name := range names {
+			units := ""
+			if gaugeMetrics[name].Unit != "" {
+				units = fmt.Sprintf(" unit=%s", gaugeMetrics[name].Unit)
+			}
+			lines = append(lines, fmt.Sprintf("%s source_id=%s instance_id=%s metric=%s %s %f %d",
+				carbon2Intrinsics(event), event.Fields["source_id"], event.Fields["instance_id"], name, units, gaugeMetrics[name].Value, event.Fields["timestamp"]))
+		}
+		msg = []byte(strings.Join(lines, "\n"))
+	case "Timer":
+		FormatTimestamp(event, "timestamp")
+		peerType := ""
+		if peerTypeString := event.Fields["peer_type"]; peerTypeString != nil && peerTypeString != "" {
+			peerType = fmt.Sprintf(" peer_type=%s", peerTypeString)
+		}
+		msg = []byte(fmt.Sprintf("%s source_id=%s instance_id=%s metric=%s_duration_ms %s unit=ms %d %d",
+			carbon2Intrinsics(event), event.Fields["source_id"], event.Fields["instance_id"], event.Fields["name"], peerType, event.Fields["duration_ms"], event.Fields["timestamp"]))
 	}
 
 	buf := new(bytes.Buffer)
 	buf.Write(msg)
+	metadata := ""
+	if events.IsMetric(eventType) {
+		metadata = carbon2Metadata(event.Tags)
+	}
 	result := ""
 	for _, message := range strings.Split(buf.String(), "\n") {
+		if metadata != "" {
+			// carbon2 separates the metadata from the intrinsic tags with two spaces
+			message = strings.Replace(message, "  ", "  "+metadata+" ", 1)
+		}
 		if WantedEvent(message, includeOnlyMatchingFilter, excludeAlwaysMatchingFilter) {
 			result += message + "\n"
 		}
@@ -320,17 +732,71 @@ func StringBuilder(event *events.Event, verboseLogMessages bool, includeOnlyMatc
 }
 
 func (s *SumoLogicAppender) AppendLogs(buffer *SumoBuffer) {
-	event := s.nozzleQueue.Pop().CopyEvent()
+	if event := s.nozzleQueue.Pop(); event != nil {
+		s.appendEvent(buffer, event)
+	}
+}
+
+// appendEvent adds an event matching the filter to the logs or to the metrics
+// of the batch. When this would make the logs or the metrics exceed
+// maxBatchBytes, they are sent first on their own.
+func (s *SumoLogicAppender) appendEvent(buffer *SumoBuffer, queued *events.Event) {
+	if !s.eventFilter.Match(queued) {
+		return
+	}
+	event := queued.CopyEvent()
 	eventString := StringBuilder(event, s.verboseLogMessages, s.includeOnlyMatchingFilter, s.excludeAlwaysMatchingFilter, s.customMetadata)
-	if event.Type == "ValueMetric" || event.Type == "CounterEvent" || event.Type == "ContainerMetric" {
-		buffer.metricStringToSend.Write([]byte(eventString))
-	} else {
-		buffer.logStringToSend.Write([]byte(eventString))
+	if eventString == "" {
+		return
+	}
+	if len(eventString) > s.maxBatchBytes {
+		eventString = s.truncate(queued, eventString)
+		if eventString == "" {
+			return
+		}
 	}
-	if eventString != "" {
-		newLines := strings.Count(eventString, "\n")
-		buffer.eventsInCurrentBuffer += newLines
+
+	isMetric := events.IsMetric(event.Type)
+	headers := s.sourceHeaders(queued)
+	part := buffer.source(headers).logStringToSend
+	if isMetric {
+		part = buffer.source(headers).metricStringToSend
+	}
+	if part.Len() > 0 && part.Len()+len(eventString) > s.maxBatchBytes {
+		logging.Trace.Println("Pushing Logs to Sumo after reaching the maximum batch size: ", part.Len())
+		buffer.eventsInCurrentBuffer -= strings.Count(part.String(), "\n")
+		s.dispatch(part.String(), isMetric, headers)
+		part.Reset()
+	}
+	part.WriteString(eventString)
+	buffer.eventsInCurrentBuffer += strings.Count(eventString, "\n")
+}
+
+// truncate shortens the message of an event whose line alone exceeds
+// maxBatchBytes, and marks it with the truncated field. It returns an empty
+// line, dropping the event, when it cannot fit.
+func (s *SumoLogicAppender) truncate(queued *events.Event, eventString string) string {
+	msg := queued.Msg
+	for excess := len(eventString) - s.maxBatchBytes; excess > 0; excess = len(eventString) - s.maxBatchBytes {
+		if events.IsMetric(queued.Type) || msg == "" {
+			logging.Warning.Printf("Dropping a %s event of %d bytes, larger than the maximum batch size", queued.Type, len(eventString))
+			return ""
+		}
+		keep := len(msg) - excess - truncationMargin
+		if keep < 0 {
+			keep = 0
+		}
+		for keep > 0 && !utf8.RuneStart(msg[keep]) {
+			keep--
+		}
+		msg = msg[:keep]
+		event := queued.CopyEvent()
+		event.Msg = msg
+		event.Fields["truncated"] = true
+		eventString = StringBuilder(event, s.verboseLogMessages, s.includeOnlyMatchingFilter, s.excludeAlwaysMatchingFilter, s.customMetadata)
 	}
+	logging.Trace.Printf("Truncated a %s event message from %d to %d bytes", queued.Type, len(queued.Msg), len(msg))
+	return eventString
 }
 
 func ParseCustomInput(customInput string) map[string][]string {
@@ -343,143 +809,175 @@ func ParseCustomInput(customInput string) map[string][]string {
 	return customInputMap
 }
 
-func (s *SumoLogicAppender) SendToSumo(logStringToSend string, url string, isMetric bool) {
+// SendToSumo posts a batch, retrying it with a jittered exponential backoff,
+// and reports whether it was delivered. Templated source headers are rendered
+// without event fields.
+func (s *SumoLogicAppender) SendToSumo(logStringToSend string, url string, isMetric bool) bool {
+	return s.send(logStringToSend, url, isMetric, s.sourceHeaders(&events.Event{})) == postDelivered
+}
+
+// send posts a batch until it is delivered, rejected or retried for
+// sumoMaxRetryDuration. The waits for the circuit breaker and between retries
+// end when the appender is drained, leaving the batch to the spool if any.
+func (s *SumoLogicAppender) send(logStringToSend string, url string, isMetric bool, headers sourceHeaders) postOutcome {
 	logging.Trace.Println("Attempting to send to Sumo Endpoint: " + url)
-	if logStringToSend != "" {
-		var buf bytes.Buffer
-		g := gzip.NewWriter(&buf)
-		g.Write([]byte(logStringToSend))
-		g.Close()
-		request, err := http.NewRequest("POST", url, &buf)
-		if err != nil {
-			logging.Error.Printf("http.NewRequest() error: %v\n", err)
-			return
+	if logStringToSend == "" {
+		return postDelivered
+	}
+	var buf bytes.Buffer
+	g := gzip.NewWriter(&buf)
+	g.Write([]byte(logStringToSend))
+	g.Close()
+
+	backoff := utils.NewBackoff(s.retryMinDelay, s.retryMaxDelay)
+	giveUp := time.Now().Add(s.sumoMaxRetryDuration)
+	for {
+		if allowed, wait := s.breaker.allow(time.Now()); !allowed {
+			if time.Now().Add(wait).After(giveUp) {
+				atomic.AddUint64(&s.stats.PostsFailed, 1)
+				logging.Error.Printf("Not able to post, the circuit breaker of %s is %v", s.breaker.name, s.breaker.getState())
+				return postRetryable
+			}
+			if !s.sleepUnlessDraining(wait) {
+				atomic.AddUint64(&s.stats.PostsFailed, 1)
+				logging.Error.Printf("Not able to post before stopping, the circuit breaker of %s is %v", s.breaker.name, s.breaker.getState())
+				return postRetryable
+			}
+			continue
 		}
-		request.Header.Add("Content-Encoding", "gzip")
-		request.Header.Add("X-Sumo-Client", "cloudfoundry-sumologic-nozzle v"+s.nozzleVersion)
+		s.reservePost()
+		statusCode, retryAfter, err := s.post(buf.Bytes(), url, isMetric, headers)
 
-		if isMetric {
-			request.Header.Add("Content-Type", "application/vnd.sumologic.carbon2")
+		outcome := classifyPost(statusCode, err)
+		s.breaker.record(outcome == postRetryable, time.Now())
+		if outcome != postDelivered {
+			s.postFailed()
 		}
-		if s.sumoName != "" {
-			request.Header.Add("X-Sumo-Name", s.sumoName)
+		switch outcome {
+		case postDelivered:
+			logging.Trace.Println("Post of logs successful")
+			s.postSent(logStringToSend)
+			return outcome
+		case postRejected:
+			atomic.AddUint64(&s.stats.PostsFailed, 1)
+			logging.Error.Printf("Endpoint rejected the post with response code: %d, dropping it", statusCode)
+			if isMetric {
+				logging.Info.Printf("Load:\n %v\n", logStringToSend)
+			}
+			return outcome
 		}
-		if s.sumoHost != "" {
-			request.Header.Add("X-Sumo-Host", s.sumoHost)
+
+		delay := backoff.Next()
+		if retryAfter > delay {
+			delay = retryAfter
 		}
-		if s.sumoCategory != "" {
-			request.Header.Add("X-Sumo-Category", s.sumoCategory)
+		if time.Now().Add(delay).After(giveUp) {
+			atomic.AddUint64(&s.stats.PostsFailed, 1)
+			logging.Error.Printf("Not able to post after %d attempts, last failure: %s", backoff.Attempts(), describePost(statusCode, err))
+			return outcome
 		}
-		//checking the timer before first POST intent
-		for time.Since(s.timerBetweenPost) < s.sumoPostMinimumDelay {
-			logging.Trace.Println("Delaying Post because minimum post timer not expired")
-			time.Sleep(100 * time.Millisecond)
+		atomic.AddUint64(&s.stats.PostsRetried, 1)
+		logging.Info.Printf("Post failed (%s), retrying in %v", describePost(statusCode, err), delay)
+		if !s.sleepUnlessDraining(delay) {
+			atomic.AddUint64(&s.stats.PostsFailed, 1)
+			logging.Error.Printf("Not able to post before stopping after %d attempts, last failure: %s", backoff.Attempts(), describePost(statusCode, err))
+			return outcome
 		}
-		response, err := s.httpClient.Do(request)
+	}
+}
 
-		if (err != nil) || (response.StatusCode != 200 && response.StatusCode != 302 && response.StatusCode < 500) {
-			logging.Info.Printf("Endpoint dropped the post send with response code: %v \n", response.StatusCode)
-			if isMetric {
-				logging.Info.Printf("Load:\n %v\n", logStringToSend)
-			}
-			logging.Info.Println("Waiting for 300 ms to retry")
-			time.Sleep(300 * time.Millisecond)
-			statusCode := 0
-			err := Retry(func(attempt int) (bool, error) {
-				var errRetry error
-				request, err := http.NewRequest("POST", url, &buf)
-				if err != nil {
-					logging.Error.Printf("http.NewRequest() error: %v\n", err)
-				}
-				request.Header.Add("Content-Encoding", "gzip")
-				request.Header.Add("X-Sumo-Client", "cloudfoundry-sumologic-nozzle v"+s.nozzleVersion)
+// reservePost waits for the minimum delay since the previous post started, and
+// reserves the current time for this one.
+func (s *SumoLogicAppender) reservePost() {
+	s.postMutex.Lock()
+	defer s.postMutex.Unlock()
+	if wait := s.sumoPostMinimumDelay - time.Since(s.timerBetweenPost); wait > 0 {
+		logging.Trace.Println("Delaying Post because minimum post timer not expired")
+		time.Sleep(wait)
+	}
+	s.timerBetweenPost = time.Now()
+}
 
-				if isMetric {
-					request.Header.Add("Content-Type", "application/vnd.sumologic.carbon2")
-				}
-				if s.sumoName != "" {
-					request.Header.Add("X-Sumo-Name", s.sumoName)
-				}
-				if s.sumoHost != "" {
-					request.Header.Add("X-Sumo-Host", s.sumoHost)
-				}
-				if s.sumoCategory != "" {
-					request.Header.Add("X-Sumo-Category", s.sumoCategory)
-				}
-				//checking the timer before POST (retry intent)
-				for time.Since(s.timerBetweenPost) < s.sumoPostMinimumDelay {
-					logging.Trace.Println("Delaying Post because minimum post timer not expired")
-					time.Sleep(100 * time.Millisecond)
-				}
-				response, errRetry = s.httpClient.Do(request)
-
-				if errRetry != nil {
-					logging.Error.Printf("http.Do() error: %v\n", errRetry)
-					logging.Info.Println("Waiting for 300 ms to retry after error")
-					time.Sleep(300 * time.Millisecond)
-					return attempt < 5, errRetry
-				} else if response.StatusCode != 200 && response.StatusCode != 302 && response.StatusCode < 500 {
-					logging.Info.Println("Endpoint dropped the post send again")
-					logging.Info.Println("Waiting for 300 ms to retry after a retry ...")
-					statusCode = response.StatusCode
-					time.Sleep(300 * time.Millisecond)
-					return attempt < 5, errRetry
-				} else if response.StatusCode == 200 {
-					logging.Trace.Println("Post of logs successful after retry...")
-					s.timerBetweenPost = time.Now()
-					statusCode = response.StatusCode
-					return true, err
-				}
-				return attempt < 5, errRetry
-			})
-			if err != nil {
-				logging.Error.Println("Error, Not able to post after retry")
-				logging.Error.Printf("http.Do() error: %v\n", err)
-				return
-			} else if statusCode != 200 {
-				logging.Error.Printf("Not able to post after retry, with status code: %d", statusCode)
-			}
-		} else if response.StatusCode == 200 {
-			logging.Trace.Println("Post of logs successful")
-			s.timerBetweenPost = time.Now()
-		}
+// post makes one POST of a gzipped batch, returning the response status code
+// and the delay asked by its Retry-After header.
+func (s *SumoLogicAppender) post(body []byte, url string, isMetric bool, headers sourceHeaders) (int, time.Duration, error) {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	request.Header.Add("Content-Encoding", "gzip")
+	request.Header.Add("X-Sumo-Client", "cloudfoundry-sumologic-nozzle v"+s.nozzleVersion)
 
-		if response != nil {
-			defer response.Body.Close()
-		}
+	if isMetric {
+		request.Header.Add("Content-Type", "application/vnd.sumologic.carbon2")
+	}
+	if headers.name != "" {
+		request.Header.Add("X-Sumo-Name", headers.name)
+	}
+	if headers.host != "" {
+		request.Header.Add("X-Sumo-Host", headers.host)
+	}
+	if headers.category != "" {
+		request.Header.Add("X-Sumo-Category", headers.category)
+	}
+	if headers.fields != "" {
+		request.Header.Add("X-Sumo-Fields", headers.fields)
+	}
+	response, err := s.httpClient.Do(request)
+	if err != nil {
+		return 0, 0, err
 	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	return response.StatusCode, parseRetryAfter(response.Header.Get("Retry-After"), time.Now()), nil
 }
 
 //------------------Retry Logic Code-------------------------------
 
-// MaxRetries is the maximum number of retries before bailing.
-var MaxRetries = 10
-var errMaxRetriesReached = errors.New("exceeded retry limit")
+type postOutcome int
 
-// Func represents functions that can be retried.
-type Func func(attempt int) (retry bool, err error)
+const (
+	postDelivered postOutcome = iota
+	// postRetryable is a network error, a throttling (429, 408) or a server
+	// error (5xx).
+	postRetryable
+	// postRejected is a permanent client error, retrying would fail again.
+	postRejected
+)
 
-// Do keeps trying the function until the second argument
-// returns false, or no error is returned.
-func Retry(fn Func) error {
-	var err error
-	var cont bool
-	attempt := 1
-	for {
-		cont, err = fn(attempt)
-		if !cont || err == nil {
-			break
-		}
-		attempt++
-		if attempt > MaxRetries {
-			return errMaxRetriesReached
-		}
+func classifyPost(statusCode int, err error) postOutcome {
+	switch {
+	case err != nil:
+		return postRetryable
+	case statusCode >= 200 && statusCode < 300:
+		return postDelivered
+	case statusCode == http.StatusTooManyRequests || statusCode == http.StatusRequestTimeout || statusCode >= 500:
+		return postRetryable
 	}
-	return err
+	return postRejected
+}
+
+func describePost(statusCode int, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("response code %d", statusCode)
 }
 
-// IsMaxRetries checks whether the error is due to hitting the
-// maximum number of retries or not.
-func IsMaxRetries(err error) bool {
-	return err == errMaxRetriesReached
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date, returning 0 when it is missing or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
 }
@@ -2,17 +2,33 @@ package sumoCFFirehose
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 
 	. "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/eventQueue"
 	. "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/events"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/logging"
+	"github.com/SumoLogic/sumologic-cloudfoundry-nozzle/spool"
 )
 
+func TestMain(m *testing.M) {
+	logging.Init(io.Discard, io.Discard, io.Discard, io.Discard)
+	os.Exit(m.Run())
+}
+
 func TestAppenderStringBuilder(t *testing.T) {
 	event1 := Event{
 		Fields: map[string]interface{}{
@@ -459,3 +475,538 @@ func TestSendNotIntNotStringTimestampField(t *testing.T) {
 	timestamp := eventStringTimestamp.Fields["timestamp"]
 	assert.Equal(t, timestamp, "", "This timestamp should be in the string")
 }
+
+func TestStringBuilderGaugeOneLinePerValue(t *testing.T) {
+	eventGauge := Event{
+		Fields: map[string]interface{}{
+			"deployment":  "cf",
+			"ip":          "10.193.166.47",
+			"job":         "diego_cell",
+			"job_index":   "c62aebe5-16b8-43f5-a589-1267e09b9537",
+			"origin":      "rep",
+			"source_id":   "7833dc75-4484-409c-9b74-90b6454906c6",
+			"instance_id": "1",
+			"timestamp":   int64(1483629662001580569),
+			"metrics": map[string]GaugeValueV2{
+				"memory": {Unit: "bytes", Value: 1024},
+				"cpu":    {Unit: "percentage", Value: 1.5},
+			},
+		},
+		Msg:  "",
+		Type: "Gauge",
+	}
+
+	finalMessage := StringBuilder(&eventGauge, true, "", "", "")
+	expectedTimestamp := int64(1483629662001580569) / int64(1000000000)
+	expected := fmt.Sprintf("deployment=cf job_index=c62aebe5-16b8-43f5-a589-1267e09b9537 ip=10.193.166.47 job=diego_cell origin=rep source_id=7833dc75-4484-409c-9b74-90b6454906c6 instance_id=1 metric=cpu  unit=percentage %f %d\n", 1.5, expectedTimestamp) +
+		fmt.Sprintf("deployment=cf job_index=c62aebe5-16b8-43f5-a589-1267e09b9537 ip=10.193.166.47 job=diego_cell origin=rep source_id=7833dc75-4484-409c-9b74-90b6454906c6 instance_id=1 metric=memory  unit=bytes %f %d\n", float64(1024), expectedTimestamp)
+	assert.Equal(t, expected, finalMessage, "")
+}
+
+func TestStringBuilderTimer(t *testing.T) {
+	eventTimer := Event{
+		Fields: map[string]interface{}{
+			"deployment":  "cf",
+			"job":         "router",
+			"job_index":   "0",
+			"origin":      "gorouter",
+			"name":        "http",
+			"source_id":   "gorouter",
+			"instance_id": "0",
+			"peer_type":   "Client",
+			"duration_ms": int64(42),
+			"timestamp":   int64(1483629662001580569),
+		},
+		Msg:  "",
+		Type: "Timer",
+	}
+
+	finalMessage := StringBuilder(&eventTimer, true, "", "", "")
+	assert.Equal(t, "deployment=cf job_index=0 job=router origin=gorouter source_id=gorouter instance_id=0 metric=http_duration_ms  peer_type=Client unit=ms 42 1483629662\n", finalMessage, "")
+}
+
+func TestStringBuilderHttpStartAndStop(t *testing.T) {
+	timestamp := int64(1483629662001580569)
+	for _, eventType := range []string{"HttpStart", "HttpStop"} {
+		event := Event{
+			Fields: map[string]interface{}{
+				"cf_app_id":   "7833dc75-4484-409c-9b74-90b6454906c6",
+				"origin":      "gorouter",
+				"peer_type":   "Client",
+				"request_id":  "4e8a8e4c-5d6f-4f5e-8e4c-5d6f4f5e8e4c",
+				"status_code": int32(200),
+				"timestamp":   timestamp,
+				"uri":         "http://app.example.com/",
+			},
+			Msg:  "",
+			Type: eventType,
+		}
+
+		finalMessage := StringBuilder(&event, false, "", "", "")
+		var parsed map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(finalMessage), &parsed), eventType)
+		assert.Equal(t, eventType, parsed["Type"])
+		fields := parsed["Fields"].(map[string]interface{})
+		assert.Equal(t, "4e8a8e4c-5d6f-4f5e-8e4c-5d6f4f5e8e4c", fields["request_id"])
+		assert.Equal(t, float64(200), fields["status_code"])
+		assert.Equal(t, time.Unix(0, timestamp).String(), fields["timestamp"], "the timestamp is formatted like the other JSON events")
+	}
+}
+
+func TestStringBuilderEnvelopeTags(t *testing.T) {
+	eventValueMetric := Event{
+		Fields: map[string]interface{}{
+			"deployment":        "cf",
+			"job":               "cloud_controller",
+			"job_index":         "0",
+			"name":              "requests.completed",
+			"origin":            "cc",
+			"value":             float64(12),
+			"timestamp":         int64(1483629662001580569),
+			"tag_placement_tag": "isolated segment",
+		},
+		Type: "ValueMetric",
+		Tags: map[string]string{"tag_placement_tag": "isolated segment"},
+	}
+	eventLogMessage := Event{
+		Fields: map[string]interface{}{
+			"timestamp":   int64(1483629662001580713),
+			"cf_app_id":   "7833dc75-4484-409c-9b74-90b6454906c6",
+			"source_type": "APP",
+			"team":        "payments",
+		},
+		Msg:  "Triggering 'app usage events fetcher'",
+		Type: "LogMessage",
+		Tags: map[string]string{"team": "payments"},
+	}
+
+	metric := StringBuilder(&eventValueMetric, false, "", "", "")
+	assert.Equal(t, fmt.Sprintf("deployment=cf job_index=0 job=cloud_controller origin=cc metric=requests.completed  tag_placement_tag=isolated_segment %f %d\n", float64(12), int64(1483629662)), metric, "")
+
+	logMessage := StringBuilder(&eventLogMessage, false, "", "", "")
+	assert.Contains(t, logMessage, "\"team\":\"payments\"", "")
+	assert.NotContains(t, logMessage, "source_type", "")
+}
+
+func TestDeliverKeepsUndeliveredBatchesInSpool(t *testing.T) {
+	status := int32(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+	sp, err := spool.Open(filepath.Join(t.TempDir(), "spool.db"), 0, 0)
+	assert.NoError(t, err)
+	defer sp.Close()
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender(server.URL, 1000, &queue, 10, 0, time.Second, 0, "", "", "", true, "", "", "", "test")
+	appender.spool = sp
+
+	appender.deliver("undelivered\n", false, sourceHeaders{})
+	batches, _, _ := appender.SpoolStats()
+	assert.Equal(t, 1, batches)
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	appender.deliver("delivered\n", false, sourceHeaders{})
+	batches, _, _ = appender.SpoolStats()
+	assert.Equal(t, 1, batches)
+
+	batch, err := sp.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "undelivered\n", batch.Payload)
+}
+
+// countingSumo is a Sumo Logic endpoint counting the lines it receives.
+func countingSumo(lines *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := gzip.NewReader(r.Body)
+		if err == nil {
+			content, _ := io.ReadAll(body)
+			atomic.AddInt64(lines, int64(bytes.Count(content, []byte("\n"))))
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func newLogEvent(msg string) *Event {
+	return &Event{
+		Fields: map[string]interface{}{
+			"cf_app_id":    "7833dc75-4484-409c-9b74-90b6454906c6",
+			"message_type": "OUT",
+			"timestamp":    int64(1483629662001580713),
+		},
+		Msg:  msg,
+		Type: "LogMessage",
+	}
+}
+
+func TestAppenderFlushesPartialBatchAfterInterval(t *testing.T) {
+	var lines int64
+	server := countingSumo(&lines)
+	defer server.Close()
+	queue := NewBoundedQueue(make([]*Event, 10), 0, 0, DropNewest)
+	appender := NewSumoLogicAppender(server.URL, 1000, queue, 100, 0, 50*time.Millisecond, 0, "", "", "", true, "", "", "", "test")
+	go appender.Start()
+
+	queue.Push(newLogEvent("first"))
+	queue.Push(newLogEvent("second"))
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&lines) == 2 }, time.Second, 10*time.Millisecond)
+}
+
+func TestDrainSendsQueuedEventsAndStops(t *testing.T) {
+	var lines int64
+	server := countingSumo(&lines)
+	defer server.Close()
+	queue := NewBoundedQueue(make([]*Event, 10), 0, 0, DropNewest)
+	appender := NewSumoLogicAppender(server.URL, 1000, queue, 100, 0, time.Hour, 0, "", "", "", true, "", "", "", "test")
+	go appender.Start()
+	queue.Push(newLogEvent("first"))
+	queue.Push(newLogEvent("second"))
+	queue.Push(newLogEvent("third"))
+
+	appender.Drain()
+	assert.Equal(t, int64(3), atomic.LoadInt64(&lines), "the partial batch is sent without waiting for the flush interval")
+	assert.False(t, appender.Running())
+	assert.Equal(t, 0, appender.InFlightPosts())
+}
+
+func TestDrainStopsSpoolReplay(t *testing.T) {
+	var lines int64
+	server := countingSumo(&lines)
+	defer server.Close()
+	sp, err := spool.Open(filepath.Join(t.TempDir(), "spool.db"), 0, 0)
+	assert.NoError(t, err)
+	defer sp.Close()
+	queue := NewBoundedQueue(make([]*Event, 10), 0, 0, DropNewest)
+	appender := NewSumoLogicAppender(server.URL, 1000, queue, 100, 0, time.Hour, 0, "", "", "", true, "", "", "", "test")
+	appender.SetupSpool(sp, time.Hour)
+	go appender.Start()
+
+	done := make(chan struct{})
+	go func() {
+		appender.Drain()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the drain waited for the spool retry period")
+	}
+}
+
+func TestDrainInterruptsOpenCircuitWait(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	queue := NewBoundedQueue(make([]*Event, 10), 0, 0, DropNewest)
+	appender := NewSumoLogicAppender(server.URL, 1000, queue, 100, 0, 10*time.Millisecond, time.Hour, "", "", "", true, "", "", "", "test")
+	appender.retryMinDelay = time.Millisecond
+	appender.retryMaxDelay = time.Millisecond
+	appender.SetupSenders("endpoint 0", 1, 1, time.Hour)
+	go appender.Start()
+	queue.Push(newLogEvent("unavailable"))
+	assert.Eventually(t, func() bool { return appender.CircuitState() == CircuitOpen }, time.Second, time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		appender.Drain()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the drain waited for the circuit breaker")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, uint64(1), appender.Stats().PostsFailed)
+}
+
+func BenchmarkAppenderThroughput(b *testing.B) {
+	var lines int64
+	server := countingSumo(&lines)
+	defer server.Close()
+	queue := NewBoundedQueue(make([]*Event, 1000), 100000, 0, Block)
+	appender := NewSumoLogicAppender(server.URL, 5000, queue, 500, 0, 100*time.Millisecond, 0, "", "", "", true, "", "", "", "test")
+	go appender.Start()
+	event := newLogEvent("benchmark log line")
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		queue.Push(event)
+	}
+	for atomic.LoadInt64(&lines) < int64(b.N) {
+		time.Sleep(time.Millisecond)
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "events/s")
+}
+
+func TestClassifyPost(t *testing.T) {
+	assert.Equal(t, postDelivered, classifyPost(200, nil))
+	assert.Equal(t, postDelivered, classifyPost(204, nil))
+	assert.Equal(t, postRetryable, classifyPost(429, nil))
+	assert.Equal(t, postRetryable, classifyPost(408, nil))
+	assert.Equal(t, postRetryable, classifyPost(500, nil))
+	assert.Equal(t, postRetryable, classifyPost(503, nil))
+	assert.Equal(t, postRetryable, classifyPost(0, fmt.Errorf("connection reset by peer")))
+	assert.Equal(t, postRejected, classifyPost(400, nil))
+	assert.Equal(t, postRejected, classifyPost(401, nil))
+	assert.Equal(t, postRejected, classifyPost(404, nil))
+	assert.Equal(t, postRejected, classifyPost(302, nil))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, 1, 5, 15, 21, 2, 0, time.UTC)
+
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("Thu, 05 Jan 2017 15:21:32 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Thu, 05 Jan 2017 15:20:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-5", now))
+}
+
+func TestSendToSumoRetriesThrottledPosts(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.NotEmpty(t, body, "retries resend the whole batch")
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender(server.URL, 1000, &queue, 10, 0, time.Second, time.Minute, "", "", "", true, "", "", "", "test")
+	appender.retryMinDelay = time.Millisecond
+	appender.retryMaxDelay = 10 * time.Millisecond
+
+	assert.True(t, appender.SendToSumo("throttled\n", server.URL, false))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Equal(t, AppenderStats{PostsSent: 1, PostsRetried: 2, BytesSent: 10}, appender.Stats())
+}
+
+func TestSendToSumoDropsRejectedPosts(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender(server.URL, 1000, &queue, 10, 0, time.Second, time.Minute, "", "", "", true, "", "", "", "test")
+
+	assert.False(t, appender.SendToSumo("rejected\n", server.URL, false))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, uint64(1), appender.Stats().PostsFailed)
+}
+
+func TestSendToSumoGivesUpAfterMaxRetryDuration(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender(server.URL, 1000, &queue, 10, 0, time.Second, 50*time.Millisecond, "", "", "", true, "", "", "", "test")
+	appender.retryMinDelay = 5 * time.Millisecond
+	appender.retryMaxDelay = 5 * time.Millisecond
+
+	start := time.Now()
+	assert.False(t, appender.SendToSumo("unavailable\n", server.URL, false))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, uint64(1), appender.Stats().PostsFailed)
+	assert.True(t, appender.Stats().PostsRetried > 0)
+}
+
+func TestSenderPoolBoundsConcurrentPosts(t *testing.T) {
+	var inFlight, maxInFlight, posts int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		for {
+			observed := atomic.LoadInt32(&maxInFlight)
+			if current <= observed || atomic.CompareAndSwapInt32(&maxInFlight, observed, current) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&inFlight, -1)
+		atomic.AddInt32(&posts, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender(server.URL, 5000, &queue, 10, 0, time.Second, time.Minute, "", "", "", true, "", "", "", "test")
+	appender.SetupSenders("endpoint 0", 2, 5, time.Minute)
+
+	dispatched := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			appender.dispatch(fmt.Sprintf("batch %d\n", i), false, sourceHeaders{})
+		}
+		close(dispatched)
+	}()
+
+	assert.Eventually(t, func() bool { return appender.InFlightPosts() == 2 }, time.Second, time.Millisecond)
+	select {
+	case <-dispatched:
+		t.Fatal("dispatch did not wait for a free sender")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-dispatched
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&posts) == 5 }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxInFlight))
+}
+
+func TestFailingSince(t *testing.T) {
+	status := int32(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender(server.URL, 1000, &queue, 10, 0, time.Second, 0, "", "", "", true, "", "", "", "test")
+	assert.True(t, appender.FailingSince().IsZero(), "an endpoint with nothing sent is not failing")
+
+	assert.False(t, appender.SendToSumo("unavailable\n", server.URL, false))
+	failingSince := appender.FailingSince()
+	assert.False(t, failingSince.IsZero())
+	assert.False(t, appender.SendToSumo("unavailable\n", server.URL, false))
+	assert.Equal(t, failingSince, appender.FailingSince(), "the first failure is kept")
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	assert.True(t, appender.SendToSumo("delivered\n", server.URL, false))
+	assert.True(t, appender.FailingSince().IsZero())
+}
+
+func TestOpenCircuitStopsPosting(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender(server.URL, 1000, &queue, 10, 0, time.Second, 100*time.Millisecond, "", "", "", true, "", "", "", "test")
+	appender.retryMinDelay = time.Millisecond
+	appender.retryMaxDelay = time.Millisecond
+	appender.SetupSenders("endpoint 0", 1, 3, time.Minute)
+
+	assert.False(t, appender.SendToSumo("unavailable\n", server.URL, false))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Equal(t, CircuitOpen, appender.CircuitState())
+
+	assert.False(t, appender.SendToSumo("unavailable\n", server.URL, false))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "no post while the circuit is open")
+}
+
+func TestAppendEventSplitsLogsAtMaxBatchBytes(t *testing.T) {
+	var lines int64
+	server := countingSumo(&lines)
+	defer server.Close()
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender(server.URL, 1000, &queue, 1000, 0, time.Second, time.Minute, "", "", "", true, "", "", "", "test")
+	appender.SetupMaxBatchBytes(600)
+	buffer := newBuffer()
+	metric := &Event{
+		Fields: map[string]interface{}{"deployment": "cf", "job": "router", "origin": "gorouter", "name": "latency", "value": 1.5, "unit": "ms", "timestamp": int64(1483629662001580713)},
+		Type:   "ValueMetric",
+	}
+
+	appender.appendEvent(&buffer, metric)
+	for i := 0; i < 5; i++ {
+		appender.appendEvent(&buffer, newLogEvent(strings.Repeat("x", 150)))
+	}
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&lines)+int64(buffer.eventsInCurrentBuffer) == 6 }, time.Second, time.Millisecond)
+	assert.True(t, buffer.source(sourceHeaders{}).logStringToSend.Len() <= 600)
+	assert.Equal(t, 1, strings.Count(buffer.source(sourceHeaders{}).metricStringToSend.String(), "\n"), "metrics are not sent with the logs")
+}
+
+func TestAppendEventTruncatesOversizedMessage(t *testing.T) {
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender("http://localhost", 1000, &queue, 1000, 0, time.Second, time.Minute, "", "", "", false, "", "", "", "test")
+	appender.SetupMaxBatchBytes(500)
+	buffer := newBuffer()
+
+	appender.appendEvent(&buffer, newLogEvent(strings.Repeat("é", 1000)))
+
+	line := buffer.source(sourceHeaders{}).logStringToSend.String()
+	assert.True(t, len(line) <= 500)
+	var parsed map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(line), &parsed))
+	assert.Equal(t, true, parsed["Fields"].(map[string]interface{})["truncated"])
+	assert.True(t, utf8.ValidString(parsed["Msg"].(string)))
+	assert.NotEmpty(t, parsed["Msg"])
+	assert.Equal(t, 1, buffer.eventsInCurrentBuffer)
+}
+
+func TestAppenderPostsEachRenderedCategorySeparately(t *testing.T) {
+	categories := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		categories <- r.Header.Get("X-Sumo-Category")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender(server.URL, 1000, &queue, 1000, 0, time.Second, time.Minute, "cf/{{cf_org_name}}/{{cf_app_name}}", "", "", true, "", "", "", "test")
+	buffer := newBuffer()
+	for _, app := range []string{"web", "worker", "web"} {
+		event := newLogEvent("hello")
+		event.Fields["cf_org_name"] = "system"
+		event.Fields["cf_app_name"] = app
+		appender.appendEvent(&buffer, event)
+	}
+
+	appender.flush(&buffer)
+
+	received := []string{<-categories, <-categories}
+	assert.ElementsMatch(t, []string{"cf/system/web", "cf/system/worker"}, received)
+	assert.Equal(t, 2, strings.Count(buffer.source(sourceHeaders{category: "cf/system/web"}).logStringToSend.String(), "\n"))
+}
+
+func TestAppenderSendsSumoFields(t *testing.T) {
+	fields := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields <- r.Header.Get("X-Sumo-Fields")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender(server.URL, 1000, &queue, 1000, 0, time.Second, time.Minute, "", "", "", true, "", "", "", "test")
+	assert.NoError(t, appender.SetupFields("environment:prod,space:{{cf_space_name}}"))
+	buffer := newBuffer()
+	for _, space := range []string{"dev", "prod"} {
+		event := newLogEvent("hello")
+		event.Fields["cf_space_name"] = space
+		appender.appendEvent(&buffer, event)
+	}
+
+	appender.flush(&buffer)
+
+	received := []string{<-fields, <-fields}
+	assert.ElementsMatch(t, []string{"environment=prod,space=dev", "environment=prod,space=prod"}, received)
+}
+
+func TestAppendEventSkipsEventsNotMatchingTheFilter(t *testing.T) {
+	queue := NewQueue(make([]*Event, 10))
+	appender := NewSumoLogicAppender("http://localhost", 1000, &queue, 1000, 0, time.Second, time.Minute, "", "", "", true, "", "", "", "test")
+	assert.Error(t, appender.SetupFilter(`message_type ==`))
+	assert.NoError(t, appender.SetupFilter(`message_type == "ERR" || timestamp < 0`))
+	buffer := newBuffer()
+	out := newLogEvent("job:diego")
+	failed := newLogEvent("failed")
+	failed.Fields["message_type"] = "ERR"
+
+	appender.appendEvent(&buffer, out)
+	appender.appendEvent(&buffer, failed)
+
+	assert.Equal(t, 1, buffer.eventsInCurrentBuffer)
+	assert.Contains(t, buffer.source(sourceHeaders{}).logStringToSend.String(), "failed")
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes jittered exponential delays between attempts, e.g. to
+// reconnect to the firehose or to retry a post.
+type Backoff struct {
+	min      time.Duration
+	max      time.Duration
+	attempts int
+}
+
+func NewBackoff(min time.Duration, max time.Duration) *Backoff {
+	if max < min {
+		max = min
+	}
+	return &Backoff{
+		min: min,
+		max: max,
+	}
+}
+
+// Next returns a delay between half and the whole of min*2^attempts, capped at max.
+func (b *Backoff) Next() time.Duration {
+	delay := b.min
+	for i := 0; i < b.attempts && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.attempts++
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Attempts returns the number of delays given since the last reset.
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Reset is called once an attempt succeeds.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
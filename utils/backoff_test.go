@@ -0,0 +1,32 @@
+package utils_test
+
+import (
+	"time"
+
+	. "github.com/SumoLogic/sumologic-cloudfoundry-nozzle/utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backoff", func() {
+	Context("Called on consecutive attempts", func() {
+		It("Should double the delay, with jitter, up to the maximum", func() {
+			backoff := NewBackoff(time.Second, 10*time.Second)
+			for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+				delay := backoff.Next()
+				Expect(delay).To(BeNumerically(">=", expected/2))
+				Expect(delay).To(BeNumerically("<=", expected))
+			}
+			Expect(backoff.Attempts()).To(Equal(6))
+		})
+	})
+	Context("Called after a reset", func() {
+		It("Should start again from the minimum delay", func() {
+			backoff := NewBackoff(time.Second, 10*time.Second)
+			backoff.Next()
+			backoff.Next()
+			backoff.Reset()
+			Expect(backoff.Next()).To(BeNumerically("<=", time.Second))
+		})
+	})
+})